@@ -21,6 +21,8 @@ package main
 // ---------------------------------------------------------------------------------------
 
 import (
+	"errors"
+	"strconv"
 	"sync"
 	"time"
 
@@ -28,86 +30,184 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// --------------------------------------------------------------------------------------
+//  constants
+// --------------------------------------------------------------------------------------
+
+const (
+	// number of points which can be added while the batch is written
+	BatchQueueSize = 10000
+)
+
+// ---------------------------------------------------------------------------------------
+//  variables
+// ---------------------------------------------------------------------------------------
+
+// ErrBatchClosed is returned when adding points to a closed batch.
+var ErrBatchClosed = errors.New("batch is closed")
+
 // ---------------------------------------------------------------------------------------
 //  types
 // ---------------------------------------------------------------------------------------
 
+// Batch collects points and writes them to the sink once the batch size is
+// reached or the timeout since the first point of the batch has expired.
+// Points are passed to a single flusher goroutine, which owns the batch and
+// writes it, so adding points does not wait for the sink. Only if the sink
+// blocks on overflow, adding points waits for a full queue as well.
 type Batch struct {
-	Size        int
-	Influx      client.Client
-	Timeout     time.Duration
-	Database    string
-	Measurement string
-
-	batch client.BatchPoints
-	timer *time.Timer
-	sync.Mutex
+	Size    int
+	Sink    Sink
+	Timeout time.Duration
+	Config  client.BatchPointsConfig
+
+	// internal variables
+	points chan *client.Point
+	done   chan struct{}
+	block  bool
+	closed bool
+	sync.RWMutex
 }
 
 // ---------------------------------------------------------------------------------------
-//  public members
+//  public functions
 // ---------------------------------------------------------------------------------------
 
-// Run is the task which writes the batch points after a certain amount of time.
-func (b *Batch) Run() {
-	b.timer = time.NewTimer(b.Timeout)
-	for range b.timer.C {
-		err := b.write()
-		if err != nil {
-			logrus.Errorln("failed to write batch:", err.Error())
-		}
-		b.timer.Reset(b.Timeout)
+// NewBatch creates a new batch and starts its flusher. A size of 0 writes
+// every point on its own, a timeout of 0 waits for the size to be reached.
+func NewBatch(sink Sink, size int, timeout time.Duration, config client.BatchPointsConfig) *Batch {
+	b := Batch{
+		Size:    size,
+		Sink:    sink,
+		Timeout: timeout,
+		Config:  config,
+		points:  make(chan *client.Point, BatchQueueSize),
+		done:    make(chan struct{}),
 	}
+	if blocker, ok := sink.(Blocker); ok {
+		b.block = blocker.Blocking()
+	}
+	go b.run()
+
+	return &b
 }
 
-// Add inserts a new point into this batch.
-func (b *Batch) Add(timestamp time.Time, tags Tags, values Values) error {
+// ---------------------------------------------------------------------------------------
+//  public members
+// ---------------------------------------------------------------------------------------
+
+// Add inserts a new point into this batch. A batch can hold points of
+// different measurements. If the queue of the flusher is full, the point
+// is dropped instead of waiting for the sink, unless the sink blocks.
+func (b *Batch) Add(measurement string, timestamp time.Time, tags Tags, values Values) error {
 	if len(values) < 1 {
 		return nil
 	}
 
-	// construct a new batch if necessary
-	if b.batch == nil {
-		b.batch, _ = client.NewBatchPoints(client.BatchPointsConfig{
-			Precision: "us",
-			Database:  b.Database,
-		})
-
-		if b.timer != nil {
-			b.timer.Reset(b.Timeout)
-		}
-	}
-
 	// construct the new databpoint for influxdb
-	pt, err := client.NewPoint(b.Measurement, tags, values, timestamp)
+	pt, err := client.NewPoint(measurement, tags, values, timestamp)
 	if err != nil {
 		return err
 	}
-	b.batch.AddPoint(pt)
 
-	// don't write the point batch to influxdb until
-	// the threshold size has been reached
-	if b.Size > 0 && len(b.batch.Points()) < b.Size {
+	b.RLock()
+	defer b.RUnlock()
+
+	if b.closed {
+		return ErrBatchClosed
+	}
+
+	// the pressure of a blocking sink is passed on to the recorder
+	if b.block {
+		b.points <- pt
 		return nil
 	}
 
-	return b.write()
+	select {
+	case b.points <- pt:
+		return nil
+	default:
+		queueDropped.Add(1)
+		return errors.New("queue of database " + b.Config.Database + " is full, dropped point (total: " +
+			strconv.FormatInt(queueDropped.Value(), 10) + ")")
+	}
 }
 
-// write writes this batch to influxdb.
-func (b *Batch) write() error {
+// Close stops accepting points, writes the pending
+// points and waits for the flusher to exit.
+func (b *Batch) Close() {
 	b.Lock()
-	defer b.Unlock()
+	if !b.closed {
+		b.closed = true
+		close(b.points)
+	}
+	b.Unlock()
 
-	if b.batch == nil {
-		return nil
+	<-b.done
+}
+
+// ---------------------------------------------------------------------------------------
+//  private members
+// ---------------------------------------------------------------------------------------
+
+// run collects the added points and writes the batch when it is full,
+// its timeout has expired or the batch is closed.
+func (b *Batch) run() {
+	defer close(b.done)
+
+	var batch client.BatchPoints
+	var timer *time.Timer
+	var expired <-chan time.Time
+
+	flush := func() {
+		if timer != nil {
+			timer.Stop()
+			timer, expired = nil, nil
+		}
+		b.write(batch)
+		batch = nil
 	}
 
-	err := b.Influx.Write(b.batch)
-	if err != nil {
-		return err
+	for {
+		select {
+		case pt, ok := <-b.points:
+			if !ok {
+				flush()
+				return
+			}
+
+			// construct a new batch if necessary, the
+			// timeout starts with its first point
+			if batch == nil {
+				batch, _ = client.NewBatchPoints(b.Config)
+				if b.Timeout > 0 {
+					timer = time.NewTimer(b.Timeout)
+					expired = timer.C
+				}
+			}
+			batch.AddPoint(pt)
+
+			// don't write the point batch to influxdb until
+			// the threshold size has been reached
+			if b.Size <= 0 || len(batch.Points()) >= b.Size {
+				flush()
+			}
+
+		case <-expired:
+			flush()
+		}
+	}
+}
+
+// write writes the batch to the sink. The sink is responsible
+// for retrying failed writes, so the batch is never kept.
+func (b *Batch) write(batch client.BatchPoints) {
+	if batch == nil {
+		return
 	}
-	b.batch = nil
 
-	return nil
+	err := b.Sink.Write(batch)
+	if err != nil {
+		logrus.Errorln("failed to write batch:", err.Error())
+	}
 }
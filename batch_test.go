@@ -0,0 +1,281 @@
+package main
+
+// sysflux
+// Copyright (C) 2018 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+// ---------------------------------------------------------------------------------------
+//  types
+// ---------------------------------------------------------------------------------------
+
+// countingSink counts the written points. Writes take the given delay
+// and wait until the release channel is closed, if one is set.
+type countingSink struct {
+	block   bool
+	delay   time.Duration
+	release chan struct{}
+	written chan int
+
+	points int64
+	writes int64
+}
+
+// mutexBatch is the previous batch implementation, which adds
+// the points under a mutex and writes the batch synchronously.
+type mutexBatch struct {
+	Size   int
+	Sink   Sink
+	Config client.BatchPointsConfig
+
+	batch client.BatchPoints
+	sync.Mutex
+}
+
+// ---------------------------------------------------------------------------------------
+//  tests
+// ---------------------------------------------------------------------------------------
+
+func TestBatchConcurrentAddClose(t *testing.T) {
+	sink := &countingSink{}
+	batch := NewBatch(sink, 10, time.Millisecond, client.BatchPointsConfig{Database: "test"})
+
+	var added, rejected int64
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				err := batch.Add("m", time.Now(), Tags{"g": "a"}, Values{"v": j})
+				if err != nil {
+					atomic.AddInt64(&rejected, 1)
+				} else {
+					atomic.AddInt64(&added, 1)
+				}
+			}
+		}()
+	}
+
+	time.Sleep(time.Millisecond)
+	batch.Close()
+	wg.Wait()
+
+	if written := atomic.LoadInt64(&sink.points); written != added {
+		t.Errorf("%d points added, but %d written", added, written)
+	}
+	if added+rejected != 8000 {
+		t.Errorf("%d points added and %d rejected, expected 8000", added, rejected)
+	}
+	if err := batch.Add("m", time.Now(), nil, Values{"v": 1}); err != ErrBatchClosed {
+		t.Errorf("add after close: expected %v, got %v", ErrBatchClosed, err)
+	}
+}
+
+func TestBatchTimeout(t *testing.T) {
+	sink := &countingSink{written: make(chan int, 1)}
+	batch := NewBatch(sink, 100, 50*time.Millisecond, client.BatchPointsConfig{Database: "test"})
+	defer batch.Close()
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		err := batch.Add("m", time.Now(), nil, Values{"v": i})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case points := <-sink.written:
+		if points != 3 {
+			t.Errorf("expected a batch of 3 points, got %d", points)
+		}
+		if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+			t.Errorf("batch written after %s, before its timeout", elapsed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("batch has not been written after its timeout")
+	}
+}
+
+func TestBatchQueueFull(t *testing.T) {
+	sink := &countingSink{release: make(chan struct{})}
+	batch := NewBatch(sink, 1, 0, client.BatchPointsConfig{Database: "test"})
+
+	// the first point blocks the flusher in the sink
+	err := batch.Add("m", time.Now(), nil, Values{"v": 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for atomic.LoadInt64(&sink.writes) < 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	for i := 0; i < BatchQueueSize; i++ {
+		err := batch.Add("m", time.Now(), nil, Values{"v": i})
+		if err != nil {
+			t.Fatalf("point %d: %s", i, err.Error())
+		}
+	}
+
+	dropped := queueDropped.Value()
+	err = batch.Add("m", time.Now(), nil, Values{"v": -1})
+	if err == nil || err == ErrBatchClosed {
+		t.Fatalf("expected the point to be dropped, got %v", err)
+	}
+	if queueDropped.Value() != dropped+1 {
+		t.Errorf("dropped point has not been counted")
+	}
+
+	close(sink.release)
+	batch.Close()
+	if written := atomic.LoadInt64(&sink.points); written != BatchQueueSize+1 {
+		t.Errorf("expected %d written points, got %d", BatchQueueSize+1, written)
+	}
+}
+
+func TestBatchQueueBlock(t *testing.T) {
+	sink := &countingSink{block: true, release: make(chan struct{})}
+	batch := NewBatch(sink, 1, 0, client.BatchPointsConfig{Database: "test"})
+
+	// the flusher is blocked by the first point, the last one waits for the queue
+	added := make(chan error)
+	go func() {
+		for i := 0; i < BatchQueueSize+2; i++ {
+			err := batch.Add("m", time.Now(), nil, Values{"v": i})
+			if err != nil {
+				added <- err
+				return
+			}
+		}
+		added <- nil
+	}()
+
+	select {
+	case err := <-added:
+		t.Fatalf("add did not wait for the full queue: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(sink.release)
+	if err := <-added; err != nil {
+		t.Fatal(err)
+	}
+	batch.Close()
+	if written := atomic.LoadInt64(&sink.points); written != BatchQueueSize+2 {
+		t.Errorf("expected %d written points, got %d", BatchQueueSize+2, written)
+	}
+}
+
+// ---------------------------------------------------------------------------------------
+//  benchmarks
+// ---------------------------------------------------------------------------------------
+
+func BenchmarkBatch(b *testing.B) {
+	for _, delay := range []time.Duration{0, time.Millisecond} {
+		b.Run("delay="+delay.String(), func(b *testing.B) {
+			batch := NewBatch(&countingSink{delay: delay}, 1000, time.Second,
+				client.BatchPointsConfig{Database: "test"})
+			defer batch.Close()
+
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					for batch.Add("m", time.Now(), Tags{"g": "a"}, Values{"v": 1}) != nil {
+						// the queue is full, wait for the flusher
+						time.Sleep(time.Microsecond)
+					}
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkMutexBatch(b *testing.B) {
+	for _, delay := range []time.Duration{0, time.Millisecond} {
+		b.Run("delay="+delay.String(), func(b *testing.B) {
+			batch := &mutexBatch{Size: 1000, Sink: &countingSink{delay: delay},
+				Config: client.BatchPointsConfig{Database: "test"}}
+
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					batch.Add("m", time.Now(), Tags{"g": "a"}, Values{"v": 1})
+				}
+			})
+		})
+	}
+}
+
+// ---------------------------------------------------------------------------------------
+//  helpers
+// ---------------------------------------------------------------------------------------
+
+func (s *countingSink) Write(bp client.BatchPoints) error {
+	atomic.AddInt64(&s.writes, 1)
+	time.Sleep(s.delay)
+	if s.release != nil {
+		<-s.release
+	}
+
+	atomic.AddInt64(&s.points, int64(len(bp.Points())))
+	if s.written != nil {
+		s.written <- len(bp.Points())
+	}
+
+	return nil
+}
+
+func (s *countingSink) Blocking() bool {
+	return s.block
+}
+
+func (s *countingSink) Close() error {
+	return nil
+}
+
+func (b *mutexBatch) Add(measurement string, timestamp time.Time, tags Tags, values Values) error {
+	pt, err := client.NewPoint(measurement, tags, values, timestamp)
+	if err != nil {
+		return err
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	if b.batch == nil {
+		b.batch, _ = client.NewBatchPoints(b.Config)
+	}
+	b.batch.AddPoint(pt)
+
+	if len(b.batch.Points()) < b.Size {
+		return nil
+	}
+
+	err = b.Sink.Write(b.batch)
+	b.batch = nil
+
+	return err
+}
@@ -0,0 +1,516 @@
+package main
+
+// sysflux
+// Copyright (C) 2018 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/sirupsen/logrus"
+)
+
+// --------------------------------------------------------------------------------------
+//  constants
+// --------------------------------------------------------------------------------------
+
+const (
+	OverflowDropOldest = "drop_oldest"
+	OverflowDropNewest = "drop_newest"
+	OverflowBlock      = "block"
+)
+
+// ---------------------------------------------------------------------------------------
+//  types
+// ---------------------------------------------------------------------------------------
+
+// BufferSink decouples the writers of batches from a sink. Batches are
+// buffered in memory and written by a separate goroutine, so a slow or
+// failing output does not delay the other outputs. Failed writes are
+// retried with an exponential backoff. If the buffer exceeds its limits
+// the overflow policy decides which points are dropped.
+type BufferSink struct {
+	Name string
+	Sink Sink
+	Conf ConfBuffer
+
+	// internal variables
+	pending   []*bufferedBatch
+	inflight  *bufferedBatch
+	points    int
+	bytes     int
+	closed    bool
+	expiry    *time.Timer
+	expired   bool
+	discarded int
+	stats     *OutputStats
+	spool     *Spool
+	signal    chan struct{}
+	done      chan struct{}
+	stopped   chan struct{}
+	space     *sync.Cond
+	sync.Mutex
+}
+
+type bufferedBatch struct {
+	bp    client.BatchPoints
+	bytes int
+}
+
+// ---------------------------------------------------------------------------------------
+//  public functions
+// ---------------------------------------------------------------------------------------
+
+// NewBufferSink creates a new buffer and starts writing its batches to the sink.
+// The name is used in log messages and statistics. If a spool directory
+// is configured, batches spooled before are written first.
+func NewBufferSink(name string, sink Sink, conf ConfBuffer) (*BufferSink, error) {
+	b := BufferSink{
+		Name:    name,
+		Sink:    sink,
+		Conf:    conf,
+		stats:   NewOutputStats(name),
+		signal:  make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	b.space = sync.NewCond(&b.Mutex)
+
+	if conf.SpoolDir != "" {
+		spool, err := OpenSpool(conf.SpoolDir, conf.SpoolMaxBytes, conf.SpoolMaxAge)
+		if err != nil {
+			return nil, err
+		}
+		b.spool = spool
+		b.stats.Spooled.Set(int64(spool.Points()))
+	}
+
+	go b.run()
+
+	return &b, nil
+}
+
+// ---------------------------------------------------------------------------------------
+//  public members
+// ---------------------------------------------------------------------------------------
+
+// Write adds the batch to the buffer. If the buffer is full the
+// batch is either dropped, older batches are dropped or the
+// call blocks until there is enough space.
+func (b *BufferSink) Write(bp client.BatchPoints) error {
+	batch := &bufferedBatch{bp: bp, bytes: batchBytes(bp)}
+	points := len(bp.Points())
+	if points < 1 {
+		return nil
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	// a batch exceeding the limits on its own can never be buffered
+	if !b.fits(points, batch.bytes, 0, 0) {
+		b.drop(points, "batch exceeds the buffer limits")
+		return nil
+	}
+
+	for !b.fits(points, batch.bytes, b.points, b.bytes) && !b.closed {
+		switch b.Conf.Overflow {
+		case OverflowDropNewest:
+			b.drop(points, "buffer is full")
+			return nil
+
+		case OverflowBlock:
+			if b.expired {
+				b.drop(points, "shutdown timeout expired")
+				b.discarded += points
+				return nil
+			}
+			b.space.Wait()
+
+		default:
+			// the batch being written is kept, if it
+			// is the only one the new batch is dropped
+			i := 0
+			if b.pending[0] == b.inflight {
+				i = 1
+			}
+			if i >= len(b.pending) {
+				b.drop(points, "buffer is full")
+				return nil
+			}
+
+			oldest := b.pending[i]
+			b.pending = append(b.pending[:i], b.pending[i+1:]...)
+			b.remove(oldest)
+			b.drop(len(oldest.bp.Points()), "buffer is full")
+		}
+	}
+
+	if b.closed {
+		b.drop(points, "buffer is closed")
+		b.discarded += points
+		return nil
+	}
+
+	b.pending = append(b.pending, batch)
+	b.points += points
+	b.bytes += batch.bytes
+	b.stats.Buffered.Set(int64(b.points))
+
+	select {
+	case b.signal <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// Shard returns the node of the series if the sink distributes
+// the series on nodes and -1 otherwise.
+func (b *BufferSink) Shard(measurement string, tags map[string]string) int {
+	if sharder, ok := b.Sink.(Sharder); ok {
+		return sharder.Shard(measurement, tags)
+	}
+
+	return -1
+}
+
+// Blocking returns true if writes wait for space in a full buffer.
+func (b *BufferSink) Blocking() bool {
+	return b.Conf.Overflow == OverflowBlock
+}
+
+// Expire wakes up the writers waiting for space once the deadline
+// has passed, their points are discarded. Only the first deadline is used.
+func (b *BufferSink) Expire(deadline time.Time) {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.expiry != nil {
+		return
+	}
+	b.expiry = time.AfterFunc(time.Until(deadline), func() {
+		b.Lock()
+		b.expired = true
+		b.space.Broadcast()
+		b.Unlock()
+	})
+
+	// buffering sinks might block as well
+	if expirer, ok := b.Sink.(Expirer); ok {
+		expirer.Expire(deadline)
+	}
+}
+
+// Drain waits until the buffered batches have been written or the deadline
+// has passed, failed writes are retried meanwhile. Afterwards the buffer is
+// closed for writing: with a spool the remaining batches are kept on disk,
+// otherwise they are discarded. The number of discarded points, including
+// the ones discarded by writers since the deadline, is returned.
+func (b *BufferSink) Drain(deadline time.Time) int {
+	b.Expire(deadline)
+
+	b.Lock()
+	for len(b.pending) > 0 && !b.expired {
+		b.space.Wait()
+	}
+	b.Unlock()
+
+	discarded := b.stop()
+
+	// buffering sinks have to be drained as well
+	if drainer, ok := b.Sink.(Drainer); ok {
+		discarded += drainer.Drain(deadline)
+	}
+
+	b.Lock()
+	discarded += b.discarded
+	b.Unlock()
+
+	return discarded
+}
+
+// Close stops the retries and closes the sink. With a spool the
+// buffered batches are kept on disk, otherwise they are discarded.
+func (b *BufferSink) Close() error {
+	b.stop()
+
+	if b.spool != nil {
+		b.spool.Close()
+	}
+
+	return b.Sink.Close()
+}
+
+// ---------------------------------------------------------------------------------------
+//  private members
+// ---------------------------------------------------------------------------------------
+
+// run writes the buffered batches in order. A failed batch is retried
+// until it has been written, was dropped or the buffer is closed. With a
+// spool failed batches are moved to disk and all newer batches follow
+// them, until the spool has been replayed.
+func (b *BufferSink) run() {
+	defer close(b.stopped)
+	backoff := b.Conf.RetryInterval
+
+	for {
+		if b.spool != nil && !b.spool.Empty() {
+			b.spoolPending()
+
+			// the spool is replayed after a restart
+			if b.isClosed() {
+				return
+			}
+
+			bp, err := b.spool.Peek()
+			if err != nil {
+				logrus.Errorf("%s: failed to read spool: %s", b.Name, err.Error())
+				backoff = b.retry(backoff)
+				continue
+			}
+
+			if bp != nil {
+				backoff = b.write(bp, backoff, func(spool bool) {
+					if !spool {
+						b.spool.Ack(len(bp.Points()))
+						b.stats.Spooled.Set(int64(b.spool.Points()))
+					}
+				})
+				continue
+			}
+		}
+
+		// the remaining batches are handled by stop
+		batch := b.first()
+		if batch == nil || b.isClosed() {
+			select {
+			case <-b.signal:
+				continue
+			case <-b.done:
+				return
+			}
+		}
+
+		backoff = b.write(batch.bp, backoff, func(spool bool) {
+			if b.complete(batch) && spool {
+				b.spoolBatch(batch.bp)
+			}
+		})
+		b.Lock()
+		b.inflight = nil
+		b.Unlock()
+	}
+}
+
+// write writes the batch and waits before the next attempt if the write
+// failed. The done function is called if the batch has been written or
+// dropped, or with spool set if the batch should be spooled. The next
+// backoff is returned.
+func (b *BufferSink) write(bp client.BatchPoints, backoff time.Duration, done func(spool bool)) time.Duration {
+	points := len(bp.Points())
+
+	err := b.Sink.Write(bp)
+	if err == nil {
+		b.stats.Written.Add(int64(points))
+		done(false)
+		return b.Conf.RetryInterval
+	}
+	b.stats.Failed.Add(1)
+
+	// a spooled batch is kept, unless it will never succeed
+	_, permanent := err.(PermanentError)
+	if permanent || (b.spool == nil && b.isClosed()) {
+		logrus.Errorf("%s: failed to write batch of %d points: %s",
+			b.Name, points, err.Error())
+		b.drop(points, "write failed")
+		done(false)
+		return backoff
+	}
+
+	logrus.Warnf("%s: failed to write batch of %d points: %s",
+		b.Name, points, err.Error())
+	if b.spool != nil {
+		done(true)
+	}
+
+	return b.retry(backoff)
+}
+
+// retry waits before the next attempt and returns the next backoff.
+func (b *BufferSink) retry(backoff time.Duration) time.Duration {
+	// the jitter prevents all outputs from retrying at once
+	wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+	logrus.Infof("%s: retrying in %s", b.Name, wait.Round(time.Millisecond))
+
+	select {
+	case <-time.After(wait):
+	case <-b.done:
+	}
+
+	backoff *= 2
+	if backoff > b.Conf.MaxRetryInterval {
+		backoff = b.Conf.MaxRetryInterval
+	}
+
+	return backoff
+}
+
+// stop closes the buffer for writing and waits for the writer to exit.
+// The remaining batches are spooled if possible, otherwise they are
+// discarded. The number of discarded points is returned.
+func (b *BufferSink) stop() int {
+	b.Lock()
+	if b.closed {
+		b.Unlock()
+		return 0
+	}
+	b.closed = true
+	b.space.Broadcast()
+	b.Unlock()
+
+	close(b.done)
+	<-b.stopped
+
+	if b.spool != nil {
+		b.spoolPending()
+		return 0
+	}
+
+	b.Lock()
+	pending := b.pending
+	b.pending = nil
+	discarded := 0
+	for _, batch := range pending {
+		b.remove(batch)
+		discarded += len(batch.bp.Points())
+	}
+	b.Unlock()
+
+	if discarded > 0 {
+		b.drop(discarded, "buffer is closed")
+	}
+
+	return discarded
+}
+
+// spoolPending moves all buffered batches to the spool.
+func (b *BufferSink) spoolPending() {
+	b.Lock()
+	pending := b.pending
+	b.pending = nil
+	for _, batch := range pending {
+		b.remove(batch)
+	}
+	b.Unlock()
+
+	for _, batch := range pending {
+		b.spoolBatch(batch.bp)
+	}
+}
+
+// spoolBatch appends the batch to the spool.
+func (b *BufferSink) spoolBatch(bp client.BatchPoints) {
+	dropped, err := b.spool.Append(bp)
+	if err != nil {
+		logrus.Errorf("%s: failed to spool batch: %s", b.Name, err.Error())
+		b.drop(len(bp.Points()), "spooling failed")
+		return
+	}
+	if dropped > 0 {
+		b.drop(dropped, "spool is full")
+	}
+
+	b.stats.Spooled.Set(int64(b.spool.Points()))
+}
+
+// first returns the oldest buffered batch, which
+// is kept in the buffer until it has been written.
+func (b *BufferSink) first() *bufferedBatch {
+	b.Lock()
+	defer b.Unlock()
+
+	if len(b.pending) < 1 || b.closed {
+		return nil
+	}
+
+	b.inflight = b.pending[0]
+	return b.inflight
+}
+
+// complete removes the batch from the buffer. False is returned
+// if the batch has already been dropped in the meantime.
+func (b *BufferSink) complete(batch *bufferedBatch) bool {
+	b.Lock()
+	defer b.Unlock()
+
+	if len(b.pending) < 1 || b.pending[0] != batch {
+		return false
+	}
+
+	b.pending = b.pending[1:]
+	b.remove(batch)
+
+	return true
+}
+
+// remove releases the space of the batch.
+func (b *BufferSink) remove(batch *bufferedBatch) {
+	b.points -= len(batch.bp.Points())
+	b.bytes -= batch.bytes
+	b.stats.Buffered.Set(int64(b.points))
+	b.space.Broadcast()
+}
+
+// drop counts and logs dropped points.
+func (b *BufferSink) drop(points int, reason string) {
+	b.stats.Dropped.Add(int64(points))
+	logrus.Warnf("%s: %s, dropped %d points (total: %d)",
+		b.Name, reason, points, b.stats.Dropped.Value())
+}
+
+// fits returns true if the batch fits into the buffer with the given usage.
+func (b *BufferSink) fits(points, bytes, usedPoints, usedBytes int) bool {
+	return (b.Conf.MaxPoints <= 0 || usedPoints+points <= b.Conf.MaxPoints) &&
+		(b.Conf.MaxBytes <= 0 || usedBytes+bytes <= b.Conf.MaxBytes)
+}
+
+func (b *BufferSink) isClosed() bool {
+	b.Lock()
+	defer b.Unlock()
+
+	return b.closed
+}
+
+// ---------------------------------------------------------------------------------------
+//  private functions
+// ---------------------------------------------------------------------------------------
+
+// batchBytes returns the size of the batch in the line protocol.
+func batchBytes(bp client.BatchPoints) int {
+	size := 0
+	for _, pt := range bp.Points() {
+		size += len(pt.String()) + 1
+	}
+
+	return size
+}
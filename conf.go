@@ -21,6 +21,9 @@ package main
 // ---------------------------------------------------------------------------------------
 
 import (
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"strings"
 	"time"
 
@@ -32,26 +35,251 @@ import (
 // ---------------------------------------------------------------------------------------
 
 type Conf struct {
-	Influx *ConfInflux   `yaml:"influx"`
-	Syslog []*ConfSyslog `yaml:"syslog"`
+	Influx          *ConfLegacyInflux      `yaml:"influx"`
+	Outputs         map[string]*ConfOutput `yaml:"outputs"`
+	Syslog          []*ConfSyslog          `yaml:"syslog"`
+	ShutdownTimeout time.Duration          `mapstructure:"shutdown_timeout"`
+}
+
+type ConfOutput struct {
+	Type string
+
+	// the settings of all output types share one namespace,
+	// e.g. url, user, password and token are reused by remote_write
+	ConfInflux      `mapstructure:",squash"`
+	ConfPrometheus  `mapstructure:",squash"`
+	ConfRemoteWrite `mapstructure:",squash"`
+	ConfGraphite    `mapstructure:",squash"`
+	ConfStatsD      `mapstructure:",squash"`
+	ConfFile        `mapstructure:",squash"`
+	ConfBuffer      `mapstructure:",squash"`
+}
+
+// ConfLegacyInflux is the influx section, which
+// configures the default output including its buffer.
+type ConfLegacyInflux struct {
+	ConfInflux `mapstructure:",squash"`
+	ConfBuffer `mapstructure:",squash"`
+}
+
+// ConfBuffer configures the write buffer every output has.
+type ConfBuffer struct {
+	MaxPoints        int           `mapstructure:"buffer_max_points"`
+	MaxBytes         int           `mapstructure:"buffer_max_bytes"`
+	Overflow         string        `mapstructure:"overflow"`
+	RetryInterval    time.Duration `mapstructure:"retry_interval"`
+	MaxRetryInterval time.Duration `mapstructure:"max_retry_interval"`
+	SpoolDir         string        `mapstructure:"spool_dir"`
+	SpoolMaxBytes    int64         `mapstructure:"spool_max_bytes"`
+	SpoolMaxAge      time.Duration `mapstructure:"spool_max_age"`
 }
 
 type ConfInflux struct {
+	Api         string
+	Protocol    string
+	PayloadSize int `mapstructure:"payload_size"`
+
+	// InfluxDB 1.x
 	Addr     string
 	User     string
 	Password string
 	Database string
+
+	// InfluxDB 2.x / 3.x: the bucket is the default database
+	URL       string
+	Org       string
+	Bucket    string
+	Token     string
+	TokenFile string `mapstructure:"token_file"`
+
+	RetentionPolicy  string `mapstructure:"retention_policy"`
+	Precision        string
+	WriteConsistency string `mapstructure:"write_consistency"`
+
+	// multiple nodes of an influxdb, replacing addr or url
+	Addrs        []string
+	Mode         string
+	VirtualNodes int `mapstructure:"virtual_nodes"`
+
+	// health checks of the nodes and the output
+	HealthInterval time.Duration `mapstructure:"health_interval"`
+	Startup        string
+
+	// http writes
+	Gzip        bool
+	MaxBodySize int `mapstructure:"max_body_size"`
+	TLS         ConfTLS
+
+	// provisioning of missing databases and retention policies
+	CreateDatabase    bool                            `mapstructure:"create_database"`
+	RetentionPolicies map[string]*ConfRetentionPolicy `mapstructure:"retention_policies"`
+
+	// static databases written by the recorders
+	databases []string
+}
+
+type ConfRetentionPolicy struct {
+	Duration      time.Duration
+	Replication   int
+	ShardDuration time.Duration `mapstructure:"shard_duration"`
+	Default       bool
+}
+
+type ConfTLS struct {
+	CA                 string
+	Cert               string
+	Key                string
+	ServerName         string `mapstructure:"server_name"`
+	InsecureSkipVerify bool   `mapstructure:"insecure_skip_verify"`
+}
+
+type ConfPrometheus struct {
+	Listen  string
+	Path    string
+	Expire  time.Duration
+	Labels  map[string]string
+	Metrics []*ConfMetric
+}
+
+type ConfRemoteWrite struct {
+	Headers map[string]string
+}
+
+type ConfGraphite struct {
+	Template   string
+	Tagged     bool
+	BufferSize int `mapstructure:"buffer_size"`
+}
+
+type ConfStatsD struct {
+	Prefix    string
+	DogStatsD bool `mapstructure:"dogstatsd"`
+}
+
+type ConfFile struct {
+	Path           string
+	Format         string
+	MaxSize        int64         `mapstructure:"max_size"`
+	RotateInterval time.Duration `mapstructure:"rotate_interval"`
+	Compress       bool
+	MaxFiles       int           `mapstructure:"max_files"`
+	MaxAge         time.Duration `mapstructure:"max_age"`
+}
+
+type ConfMetric struct {
+	Measurement string
+	Field       string
+	Type        string
+	Name        string
+	Help        string
+	Buckets     []float64
 }
 
 type ConfSyslog struct {
-	Database     string
-	Measurement  string
-	Listen       string
-	Regex        string
-	BatchSize    int           `mapstructure:"batch_size"`
-	BatchTimeout time.Duration `mapstructure:"batch_timeout"`
+	Output           string
+	DryRun           bool `mapstructure:"dry_run"`
+	Database         string
+	RetentionPolicy  string `mapstructure:"retention_policy"`
+	Precision        string
+	WriteConsistency string `mapstructure:"write_consistency"`
+	Measurement      string
+	Listen           string
+	Regex            string
+	BatchSize        int           `mapstructure:"batch_size"`
+	BatchTimeout     time.Duration `mapstructure:"batch_timeout"`
+	Derive           []*ConfDerive
+	Correlate        []*ConfCorrelate
+	Routes           []*ConfRoute
+	Outputs          []*ConfSyslogOutput
+}
+
+// ConfSyslogOutput is an output a recorder writes to. Settings
+// which are not configured are inherited from the recorder.
+type ConfSyslogOutput struct {
+	Output           string
+	Match            map[string]string
+	Database         string
+	RetentionPolicy  string `mapstructure:"retention_policy"`
+	Precision        string
+	WriteConsistency string        `mapstructure:"write_consistency"`
+	BatchSize        int           `mapstructure:"batch_size"`
+	BatchTimeout     time.Duration `mapstructure:"batch_timeout"`
+	Routes           []*ConfRoute
+}
+
+type ConfRoute struct {
+	Match           map[string]string
+	Database        string
+	RetentionPolicy string        `mapstructure:"retention_policy"`
+	BatchSize       int           `mapstructure:"batch_size"`
+	BatchTimeout    time.Duration `mapstructure:"batch_timeout"`
+}
+
+type ConfCorrelate struct {
+	Measurement string
+	Start       string
+	End         string
+	Key         string
+	Timeout     time.Duration
+	MaxPending  int `mapstructure:"max_pending"`
+}
+
+type ConfDerive struct {
+	Tag   string
+	Field string
+	Expr  string
 }
 
+// ---------------------------------------------------------------------------------------
+//  constants
+// ---------------------------------------------------------------------------------------
+
+const (
+	DefaultOutput    = ""
+	DefaultPrecision = "us"
+
+	DefaultShutdownTimeout = 10 * time.Second
+
+	DefaultBufferMaxPoints  = 100000
+	DefaultBufferMaxBytes   = 32 << 20
+	DefaultRetryInterval    = time.Second
+	DefaultMaxRetryInterval = time.Minute
+	DefaultSpoolMaxBytes    = 1 << 30
+
+	DefaultHealthInterval = 10 * time.Second
+	DefaultVirtualNodes   = 128
+
+	OutputInflux      = "influx"
+	OutputPrometheus  = "prometheus"
+	OutputRemoteWrite = "remote_write"
+	OutputGraphite    = "graphite"
+	OutputOpenTSDB    = "opentsdb"
+	OutputStatsD      = "statsd"
+	OutputFile        = "file"
+
+	DefaultPrometheusPath   = "/metrics"
+	DefaultPrometheusExpire = 5 * time.Minute
+
+	DefaultOpenTSDBMaxBodySize = 512 << 10
+
+	DefaultGraphiteTemplate       = "{tags}.{measurement}.{field}"
+	DefaultGraphiteTaggedTemplate = "{measurement}.{field}"
+
+	// fits into a single ethernet frame
+	DefaultStatsDPayloadSize = 1432
+
+	MetricCounter   = "counter"
+	MetricGauge     = "gauge"
+	MetricHistogram = "histogram"
+	MetricTimer     = "timer"
+)
+
+var (
+	validPrecisions    = []string{"ns", "us", "ms", "s", "m", "h"}
+	validPrecisionsV2  = []string{"ns", "us", "ms", "s"}
+	validConsistencies = []string{"", "any", "one", "quorum", "all"}
+)
+
 // ---------------------------------------------------------------------------------------
 //  public functions
 // ---------------------------------------------------------------------------------------
@@ -79,12 +307,494 @@ func LoadConf() (*Conf, error) {
 		return nil, err
 	}
 
-	// set the default database if no other is specified
-	for i := range conf.Syslog {
-		if conf.Syslog[i].Database == "" {
-			conf.Syslog[i].Database = conf.Influx.Database
+	if conf.Influx == nil {
+		conf.Influx = &ConfLegacyInflux{}
+	}
+	if conf.ShutdownTimeout <= 0 {
+		conf.ShutdownTimeout = DefaultShutdownTimeout
+	}
+
+	// the influx section is the default output
+	if conf.Outputs == nil {
+		conf.Outputs = make(map[string]*ConfOutput)
+	}
+	conf.Outputs[DefaultOutput] = &ConfOutput{
+		Type:       OutputInflux,
+		ConfInflux: conf.Influx.ConfInflux,
+		ConfBuffer: conf.Influx.ConfBuffer,
+	}
+
+	for name, output := range conf.Outputs {
+		err = output.validate()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", OutputName(name), err.Error())
+		}
+	}
+
+	for i, syslog := range conf.Syslog {
+		// a recorder without output list writes to a single output
+		explicit := len(syslog.Outputs) > 0
+		if !explicit {
+			syslog.Outputs = []*ConfSyslogOutput{{Output: syslog.Output}}
+		}
+
+		for j, target := range syslog.Outputs {
+			prefix := fmt.Sprintf("syslog(%d): ", i)
+			if explicit {
+				prefix += fmt.Sprintf("outputs(%d): ", j)
+			}
+
+			output, ok := conf.Outputs[target.Output]
+			if !ok {
+				return nil, fmt.Errorf("%sunknown output \"%s\"", prefix, target.Output)
+			}
+
+			target.inherit(syslog, &output.ConfInflux)
+			err = target.validate(output)
+			if err != nil {
+				return nil, fmt.Errorf("%s%s", prefix, err.Error())
+			}
+			output.addDatabases(target)
 		}
 	}
 
 	return &conf, nil
 }
+
+// OutputName returns the name of an output as used in log messages.
+func OutputName(name string) string {
+	if name == DefaultOutput {
+		return "influx"
+	}
+
+	return "outputs(" + name + ")"
+}
+
+// ---------------------------------------------------------------------------------------
+//  private members
+// ---------------------------------------------------------------------------------------
+
+// validate checks the output configuration and sets its defaults.
+func (c *ConfOutput) validate() error {
+	err := c.ConfBuffer.validate()
+	if err != nil {
+		return err
+	}
+
+	if (c.TLS.Cert == "") != (c.TLS.Key == "") {
+		return errors.New("tls: cert and key must be configured together")
+	}
+
+	switch c.Type {
+	case "", OutputInflux:
+		c.Type = OutputInflux
+		return c.ConfInflux.validate()
+
+	case OutputPrometheus:
+		return c.ConfPrometheus.validate()
+
+	case OutputRemoteWrite:
+		if c.URL == "" {
+			return errors.New("no url configured")
+		}
+		return nil
+
+	case OutputGraphite:
+		if c.Addr == "" {
+			return errors.New("no addr configured")
+		}
+		return c.ConfGraphite.validate()
+
+	case OutputOpenTSDB:
+		switch c.Protocol {
+		case "", ProtocolTelnet:
+			c.Protocol = ProtocolTelnet
+			if c.Addr == "" {
+				return errors.New("no addr configured")
+			}
+		case ProtocolHTTP:
+			if c.URL == "" {
+				return errors.New("no url configured")
+			}
+			if c.MaxBodySize <= 0 {
+				c.MaxBodySize = DefaultOpenTSDBMaxBodySize
+			}
+		default:
+			return fmt.Errorf("invalid protocol \"%s\": must be one of %s, %s",
+				c.Protocol, ProtocolTelnet, ProtocolHTTP)
+		}
+		return nil
+
+	case OutputStatsD:
+		return c.validateStatsD()
+
+	case OutputFile:
+		return c.ConfFile.validate()
+	}
+
+	return fmt.Errorf("invalid type \"%s\": must be one of %s", c.Type, strings.Join([]string{
+		OutputInflux, OutputPrometheus, OutputRemoteWrite, OutputGraphite, OutputOpenTSDB, OutputStatsD, OutputFile,
+	}, ", "))
+}
+
+// token returns the configured token, which is read from
+// the token file if configured.
+func (c *ConfInflux) token() (string, error) {
+	if c.TokenFile == "" {
+		return c.Token, nil
+	}
+
+	buf, err := ioutil.ReadFile(c.TokenFile)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(buf)), nil
+}
+
+// validate checks the influxdb configuration and sets its defaults.
+func (c *ConfInflux) validate() error {
+	if c.Precision == "" {
+		c.Precision = DefaultPrecision
+	}
+
+	if c.HealthInterval <= 0 {
+		c.HealthInterval = DefaultHealthInterval
+	}
+
+	switch c.Startup {
+	case "":
+		c.Startup = StartupContinue
+	case StartupContinue, StartupWait, StartupFail:
+	default:
+		return fmt.Errorf("invalid startup \"%s\": must be one of %s, %s, %s",
+			c.Startup, StartupContinue, StartupWait, StartupFail)
+	}
+
+	err := c.validateNodes()
+	if err != nil {
+		return err
+	}
+
+	err = c.validateProvisioning()
+	if err != nil {
+		return err
+	}
+
+	switch c.Protocol {
+	case "", ProtocolHTTP:
+	case ProtocolUDP:
+		if c.Api == ApiV2 {
+			return errors.New("udp is not supported by the v2 api")
+		}
+		if c.Addr == "" && len(c.Addrs) < 1 {
+			return errors.New("no addr configured")
+		}
+		return nil
+	default:
+		return fmt.Errorf("invalid protocol \"%s\": must be one of %s, %s",
+			c.Protocol, ProtocolHTTP, ProtocolUDP)
+	}
+
+	switch c.Api {
+	case "", ApiV1:
+		return nil
+
+	case ApiV2:
+		if c.Database == "" {
+			c.Database = c.Bucket
+		}
+		if c.URL == "" && c.Addr == "" && len(c.Addrs) < 1 {
+			return errors.New("no url configured")
+		}
+		if c.Org == "" {
+			return errors.New("no org configured")
+		}
+		if c.Token == "" && c.TokenFile == "" {
+			return errors.New("no token or token_file configured")
+		}
+		return nil
+	}
+
+	return fmt.Errorf("invalid api \"%s\": must be one of %s, %s", c.Api, ApiV1, ApiV2)
+}
+
+// validateProvisioning checks the settings for creating databases
+// and retention policies and sets their defaults.
+func (c *ConfInflux) validateProvisioning() error {
+	if !c.CreateDatabase {
+		return nil
+	}
+	if c.Protocol == ProtocolUDP || c.Api == ApiV2 {
+		return errors.New("create_database is only supported by the v1 http api")
+	}
+
+	defaults := 0
+	for name, rp := range c.RetentionPolicies {
+		if rp.Duration < 0 || rp.ShardDuration < 0 {
+			return fmt.Errorf("retention_policies(%s): negative duration", name)
+		}
+		if rp.Replication <= 0 {
+			rp.Replication = 1
+		}
+		if rp.Default {
+			defaults++
+		}
+	}
+	if defaults > 1 {
+		return errors.New("only one retention policy can be the default")
+	}
+
+	return nil
+}
+
+// addDatabases remembers the databases the recorder writes to,
+// which are created on startup. Databases depending on the
+// log messages are created on their first write.
+func (c *ConfInflux) addDatabases(target *ConfSyslogOutput) {
+	add := func(database string) {
+		if database == "" || strings.ContainsRune(database, '{') || contains(c.databases, database) {
+			return
+		}
+		c.databases = append(c.databases, database)
+	}
+
+	add(target.Database)
+	for _, route := range target.Routes {
+		add(route.Database)
+	}
+}
+
+// validateNodes checks the settings of multiple influxdb nodes.
+func (c *ConfInflux) validateNodes() error {
+	if len(c.Addrs) < 1 {
+		return nil
+	}
+	if c.Addr != "" || c.URL != "" {
+		return errors.New("addrs cannot be combined with addr or url")
+	}
+
+	switch c.Mode {
+	case "":
+		c.Mode = ModeFailover
+	case ModeFailover, ModeReplicate, ModeShard:
+	default:
+		return fmt.Errorf("invalid mode \"%s\": must be one of %s, %s, %s",
+			c.Mode, ModeFailover, ModeReplicate, ModeShard)
+	}
+
+	if c.VirtualNodes <= 0 {
+		c.VirtualNodes = DefaultVirtualNodes
+	}
+
+	return nil
+}
+
+// validate checks the prometheus configuration and sets its defaults.
+func (c *ConfPrometheus) validate() error {
+	if c.Listen == "" {
+		return errors.New("no listen address configured")
+	}
+	if c.Path == "" {
+		c.Path = DefaultPrometheusPath
+	}
+	if c.Expire == 0 {
+		c.Expire = DefaultPrometheusExpire
+	}
+	if c.Expire < time.Second {
+		return errors.New("expire must be at least 1s")
+	}
+
+	// different tags must not end up in the same label
+	tags := make(map[string]string, len(c.Labels))
+	for tag, label := range c.Labels {
+		name := sanitizePromName(label, false)
+		if other, ok := tags[name]; ok {
+			return fmt.Errorf("labels: tags %s and %s both map to label %s", other, tag, name)
+		}
+		tags[name] = tag
+	}
+
+	return validateMetrics(c.Metrics, MetricCounter, MetricGauge, MetricHistogram)
+}
+
+// validate checks the buffer configuration and sets its defaults.
+func (c *ConfBuffer) validate() error {
+	if c.MaxPoints == 0 {
+		c.MaxPoints = DefaultBufferMaxPoints
+	}
+	if c.MaxBytes == 0 {
+		c.MaxBytes = DefaultBufferMaxBytes
+	}
+	if c.RetryInterval <= 0 {
+		c.RetryInterval = DefaultRetryInterval
+	}
+	if c.MaxRetryInterval <= 0 {
+		c.MaxRetryInterval = DefaultMaxRetryInterval
+	}
+	if c.SpoolMaxBytes == 0 {
+		c.SpoolMaxBytes = DefaultSpoolMaxBytes
+	}
+	if c.MaxRetryInterval < c.RetryInterval {
+		c.MaxRetryInterval = c.RetryInterval
+	}
+
+	switch c.Overflow {
+	case "":
+		c.Overflow = OverflowDropOldest
+	case OverflowDropOldest, OverflowDropNewest, OverflowBlock:
+	default:
+		return fmt.Errorf("invalid overflow \"%s\": must be one of %s, %s, %s",
+			c.Overflow, OverflowDropOldest, OverflowDropNewest, OverflowBlock)
+	}
+
+	return nil
+}
+
+// validate checks the graphite configuration and sets its defaults.
+func (c *ConfGraphite) validate() error {
+	if c.Template == "" {
+		c.Template = DefaultGraphiteTemplate
+		if c.Tagged {
+			c.Template = DefaultGraphiteTaggedTemplate
+		}
+	}
+	if c.BufferSize <= 0 {
+		c.BufferSize = DefaultLineBufferSize
+	}
+
+	_, err := compileGraphiteTemplate(c.Template)
+	return err
+}
+
+// validateStatsD checks the statsd configuration and sets its defaults.
+func (c *ConfOutput) validateStatsD() error {
+	if c.Addr == "" {
+		return errors.New("no addr configured")
+	}
+	if c.PayloadSize <= 0 {
+		c.PayloadSize = DefaultStatsDPayloadSize
+	}
+
+	return validateMetrics(c.Metrics, MetricCounter, MetricGauge, MetricTimer)
+}
+
+// validate checks the file configuration and sets its defaults.
+func (c *ConfFile) validate() error {
+	if c.Path == "" {
+		return errors.New("no path configured")
+	}
+
+	switch c.Format {
+	case "":
+		c.Format = FormatLineProtocol
+	case FormatLineProtocol, FormatJSON:
+	default:
+		return fmt.Errorf("invalid format \"%s\": must be one of %s, %s",
+			c.Format, FormatLineProtocol, FormatJSON)
+	}
+
+	return nil
+}
+
+// inherit sets the settings which are not configured to the ones of the
+// recorder. The default write settings are the ones of the influxdb.
+func (c *ConfSyslogOutput) inherit(syslog *ConfSyslog, influx *ConfInflux) {
+	if c.Database == "" {
+		c.Database = syslog.Database
+	}
+	if c.Database == "" {
+		c.Database = influx.Database
+	}
+	if c.RetentionPolicy == "" {
+		c.RetentionPolicy = syslog.RetentionPolicy
+	}
+	if c.RetentionPolicy == "" {
+		c.RetentionPolicy = influx.RetentionPolicy
+	}
+	if c.Precision == "" {
+		c.Precision = syslog.Precision
+	}
+	if c.Precision == "" {
+		c.Precision = influx.Precision
+	}
+	if c.WriteConsistency == "" {
+		c.WriteConsistency = syslog.WriteConsistency
+	}
+	if c.WriteConsistency == "" {
+		c.WriteConsistency = influx.WriteConsistency
+	}
+	if c.BatchSize == 0 {
+		c.BatchSize = syslog.BatchSize
+	}
+	if c.BatchTimeout == 0 {
+		c.BatchTimeout = syslog.BatchTimeout
+	}
+	if c.Routes == nil {
+		c.Routes = syslog.Routes
+	}
+}
+
+// validate checks the write settings of the recorder output.
+func (c *ConfSyslogOutput) validate(output *ConfOutput) error {
+	if output.Type != OutputInflux {
+		return nil
+	}
+
+	precisions := validPrecisions
+	if output.Api == ApiV2 {
+		precisions = validPrecisionsV2
+	}
+
+	// the database is selected by the udp listener of influxdb
+	if c.Database == "" && output.Protocol != ProtocolUDP {
+		return errors.New("no database configured")
+	}
+
+	if !contains(precisions, c.Precision) {
+		return fmt.Errorf("invalid precision \"%s\": must be one of %s",
+			c.Precision, strings.Join(precisions, ", "))
+	}
+
+	if !contains(validConsistencies, c.WriteConsistency) {
+		return fmt.Errorf("invalid write_consistency \"%s\": must be one of %s",
+			c.WriteConsistency, strings.Join(validConsistencies[1:], ", "))
+	}
+
+	return nil
+}
+
+// ---------------------------------------------------------------------------------------
+//  private functions
+// ---------------------------------------------------------------------------------------
+
+// validateMetrics checks the field mappings of metric outputs.
+// The type defaults to gauge and must be one of the given types.
+func validateMetrics(metrics []*ConfMetric, types ...string) error {
+	for i, metric := range metrics {
+		if metric.Field == "" {
+			return fmt.Errorf("metrics(%d): no field configured", i)
+		}
+
+		if metric.Type == "" {
+			metric.Type = MetricGauge
+		}
+		if !contains(types, metric.Type) {
+			return fmt.Errorf("metrics(%d): invalid type \"%s\": must be one of %s",
+				i, metric.Type, strings.Join(types, ", "))
+		}
+	}
+
+	return nil
+}
+
+// contains returns true if the slice contains the string.
+func contains(slice []string, s string) bool {
+	for _, v := range slice {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,295 @@
+package main
+
+// sysflux
+// Copyright (C) 2018 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"container/list"
+	"errors"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// --------------------------------------------------------------------------------------
+//  constants
+// --------------------------------------------------------------------------------------
+
+const (
+	DefaultCorrelateTimeout    = 10 * time.Minute
+	DefaultCorrelateMaxPending = 10000
+
+	FieldDuration = "duration"
+	FieldTimeouts = "timeouts"
+	FieldRestarts = "restarts"
+)
+
+// ---------------------------------------------------------------------------------------
+//  types
+// ---------------------------------------------------------------------------------------
+
+// Correlator matches start and end events sharing the same key
+// and emits a point containing the duration between both events.
+type Correlator struct {
+	Conf ConfCorrelate
+
+	// internal variables
+	start    *regexp.Regexp
+	end      *regexp.Regexp
+	pending  map[string]*list.Element
+	order    *list.List
+	timeouts uint64
+	restarts uint64
+	reported [2]uint64
+	fanout   *Fanout
+	done     chan struct{}
+	stopped  chan struct{}
+	sync.Mutex
+}
+
+// pendingEvent is a start event waiting for its end event.
+type pendingEvent struct {
+	key       string
+	timestamp time.Time
+	tags      Tags
+	values    Values
+}
+
+// ---------------------------------------------------------------------------------------
+//  public functions
+// ---------------------------------------------------------------------------------------
+
+// NewCorrelator creates a new correlator which writes its points
+// through the given fanout.
+func NewCorrelator(conf ConfCorrelate, fanout *Fanout) (*Correlator, error) {
+	if conf.Timeout <= 0 {
+		conf.Timeout = DefaultCorrelateTimeout
+	}
+	if conf.MaxPending <= 0 {
+		conf.MaxPending = DefaultCorrelateMaxPending
+	}
+	if conf.Measurement == "" {
+		return nil, errors.New("no measurement configured")
+	}
+
+	start, err := regexp.Compile(conf.Start)
+	if err != nil {
+		return nil, err
+	}
+
+	end, err := regexp.Compile(conf.End)
+	if err != nil {
+		return nil, err
+	}
+
+	// the key capture group must exist in both patterns
+	if !hasSubexp(start, PrefixTag+conf.Key) || !hasSubexp(end, PrefixTag+conf.Key) {
+		return nil, errors.New("key capture group \"" + PrefixTag + conf.Key +
+			"\" missing in start or end pattern")
+	}
+
+	return &Correlator{
+		Conf:    conf,
+		start:   start,
+		end:     end,
+		pending: make(map[string]*list.Element),
+		order:   list.New(),
+		fanout:  fanout,
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}, nil
+}
+
+// Run periodically expires pending start events until the correlator is stopped.
+func (c *Correlator) Run() {
+	defer close(c.stopped)
+
+	interval := c.Conf.Timeout / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case now := <-ticker.C:
+			c.expire(now)
+		}
+	}
+}
+
+// Stop stops the expiration of pending start events.
+func (c *Correlator) Stop() {
+	close(c.done)
+	<-c.stopped
+}
+
+// Handle checks if the given log message is a start or end event.
+// True is returned if the message was consumed by this correlator.
+func (c *Correlator) Handle(timestamp time.Time, content string) bool {
+	if matches := c.start.FindStringSubmatch(content); matches != nil {
+		tags, values, err := process(c.start, matches)
+		if err != nil {
+			logrus.Warnln("failed to process start event:", err.Error())
+			return true
+		}
+
+		c.Lock()
+		c.begin(&pendingEvent{
+			key:       tags[c.Conf.Key],
+			timestamp: timestamp,
+			tags:      tags,
+			values:    values,
+		})
+		c.Unlock()
+
+		return true
+	}
+
+	if matches := c.end.FindStringSubmatch(content); matches != nil {
+		tags, values, err := process(c.end, matches)
+		if err != nil {
+			logrus.Warnln("failed to process end event:", err.Error())
+			return true
+		}
+
+		c.Lock()
+		event := c.finish(tags[c.Conf.Key])
+		c.Unlock()
+
+		if event == nil {
+			logrus.Debugln("ignoring end event without start:", content)
+			return true
+		}
+
+		// the point consists of the captures of both events
+		for k, v := range tags {
+			event.tags[k] = v
+		}
+		for k, v := range values {
+			event.values[k] = v
+		}
+		event.values[FieldDuration] = timestamp.Sub(event.timestamp).Seconds()
+
+		err = c.fanout.Add(tagVars(event.tags), c.Conf.Measurement, timestamp, event.tags, event.values)
+		if err != nil {
+			logrus.Errorln("failed to write correlated datapoint:", err.Error())
+		}
+
+		return true
+	}
+
+	return false
+}
+
+// ---------------------------------------------------------------------------------------
+//  private members
+// ---------------------------------------------------------------------------------------
+
+// begin adds a new pending start event. If the table is full
+// the oldest pending event is discarded.
+func (c *Correlator) begin(event *pendingEvent) {
+	// a restarted event replaces the previous one
+	if elem, ok := c.pending[event.key]; ok {
+		c.order.Remove(elem)
+		delete(c.pending, event.key)
+		c.restarts++
+	}
+
+	if c.order.Len() >= c.Conf.MaxPending {
+		oldest := c.order.Front()
+		c.order.Remove(oldest)
+		delete(c.pending, oldest.Value.(*pendingEvent).key)
+		c.timeouts++
+
+		logrus.Warnf("correlation %s: too many pending events, discarding oldest",
+			c.Conf.Measurement)
+	}
+
+	c.pending[event.key] = c.order.PushBack(event)
+}
+
+// finish removes and returns the pending event for the given key.
+func (c *Correlator) finish(key string) *pendingEvent {
+	elem, ok := c.pending[key]
+	if !ok {
+		return nil
+	}
+
+	c.order.Remove(elem)
+	delete(c.pending, key)
+
+	return elem.Value.(*pendingEvent)
+}
+
+// expire removes all pending events which are older than the
+// configured timeout and writes the updated counters.
+func (c *Correlator) expire(now time.Time) {
+	c.Lock()
+	expired := 0
+	for elem := c.order.Front(); elem != nil; elem = c.order.Front() {
+		event := elem.Value.(*pendingEvent)
+		if now.Sub(event.timestamp) < c.Conf.Timeout {
+			break
+		}
+
+		c.order.Remove(elem)
+		delete(c.pending, event.key)
+		expired++
+	}
+	c.timeouts += uint64(expired)
+	counters := [2]uint64{c.timeouts, c.restarts}
+	changed := counters != c.reported
+	c.reported = counters
+	c.Unlock()
+
+	if !changed {
+		return
+	}
+
+	err := c.fanout.Add(nil, c.Conf.Measurement, now, Tags{}, Values{
+		FieldTimeouts: int64(counters[0]),
+		FieldRestarts: int64(counters[1]),
+	})
+	if err != nil {
+		logrus.Errorln("failed to write correlation timeouts:", err.Error())
+	}
+}
+
+// ---------------------------------------------------------------------------------------
+//  private functions
+// ---------------------------------------------------------------------------------------
+
+// hasSubexp returns true if the regex contains the named capture group.
+func hasSubexp(re *regexp.Regexp, name string) bool {
+	for _, n := range re.SubexpNames() {
+		if n == name {
+			return true
+		}
+	}
+
+	return false
+}
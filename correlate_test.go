@@ -0,0 +1,183 @@
+package main
+
+// sysflux
+// Copyright (C) 2018 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+// ---------------------------------------------------------------------------------------
+//  types
+// ---------------------------------------------------------------------------------------
+
+// recordingSink records the written points in line protocol.
+type recordingSink struct {
+	points []string
+	sync.Mutex
+}
+
+// ---------------------------------------------------------------------------------------
+//  tests
+// ---------------------------------------------------------------------------------------
+
+func TestCorrelateDuration(t *testing.T) {
+	sink, fanout := newCorrelateTest(t)
+	c := newTestCorrelator(t, fanout, 0)
+
+	t0 := time.Unix(1000, 0)
+	c.Handle(t0, "start a")
+	c.Handle(t0.Add(1500*time.Millisecond), "end a 3")
+	c.Handle(t0.Add(2*time.Second), "end a 4")
+	fanout.Close()
+
+	sink.check(t,
+		"jobs,id=a code=3,duration=1.5 1001500000000",
+	)
+}
+
+func TestCorrelateTimeout(t *testing.T) {
+	sink, fanout := newCorrelateTest(t)
+	c := newTestCorrelator(t, fanout, 0)
+
+	t0 := time.Unix(1000, 0)
+	c.Handle(t0, "start a")
+	c.Handle(t0.Add(30*time.Second), "start b")
+
+	// only the start event older than the timeout expires
+	c.expire(t0.Add(time.Minute))
+	c.Handle(t0.Add(time.Minute), "end a 1")
+	c.Handle(t0.Add(time.Minute), "end b 0")
+
+	// unchanged counters are not written again
+	c.expire(t0.Add(2 * time.Minute))
+	fanout.Close()
+
+	sink.check(t,
+		"jobs restarts=0i,timeouts=1i 1060000000000",
+		"jobs,id=b code=0,duration=30 1060000000000",
+	)
+}
+
+func TestCorrelateMaxPending(t *testing.T) {
+	sink, fanout := newCorrelateTest(t)
+	c := newTestCorrelator(t, fanout, 2)
+
+	// the oldest start event is discarded
+	t0 := time.Unix(1000, 0)
+	c.Handle(t0, "start a")
+	c.Handle(t0.Add(time.Second), "start b")
+	c.Handle(t0.Add(2*time.Second), "start c")
+	c.Handle(t0.Add(3*time.Second), "end a 0")
+	c.Handle(t0.Add(3*time.Second), "end b 0")
+	c.Handle(t0.Add(3*time.Second), "end c 0")
+	c.expire(t0.Add(4 * time.Second))
+	fanout.Close()
+
+	sink.check(t,
+		"jobs,id=b code=0,duration=2 1003000000000",
+		"jobs,id=c code=0,duration=1 1003000000000",
+		"jobs restarts=0i,timeouts=1i 1004000000000",
+	)
+}
+
+func TestCorrelateRestart(t *testing.T) {
+	sink, fanout := newCorrelateTest(t)
+	c := newTestCorrelator(t, fanout, 0)
+
+	// a restart is not counted as timeout
+	t0 := time.Unix(1000, 0)
+	c.Handle(t0, "start a")
+	c.Handle(t0.Add(time.Second), "start a")
+	c.Handle(t0.Add(3*time.Second), "end a 0")
+	c.expire(t0.Add(4 * time.Second))
+	fanout.Close()
+
+	sink.check(t,
+		"jobs,id=a code=0,duration=2 1003000000000",
+		"jobs restarts=1i,timeouts=0i 1004000000000",
+	)
+}
+
+// ---------------------------------------------------------------------------------------
+//  helpers
+// ---------------------------------------------------------------------------------------
+
+// newCorrelateTest creates a fanout writing every point to the returned sink.
+func newCorrelateTest(t *testing.T) (*recordingSink, *Fanout) {
+	sink := &recordingSink{}
+	router, err := NewRouter(&ConfSyslogOutput{Database: "logs", BatchSize: 1}, sink, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fanout := &Fanout{}
+	fanout.AddOutput("test", nil, router)
+
+	return sink, fanout
+}
+
+// newTestCorrelator creates a correlator of jobs with a timeout of one minute.
+func newTestCorrelator(t *testing.T, fanout *Fanout, maxPending int) *Correlator {
+	c, err := NewCorrelator(ConfCorrelate{
+		Measurement: "jobs",
+		Start:       `start (?P<tag_id>\S+)`,
+		End:         `end (?P<tag_id>\S+) (?P<val_code>\d+)`,
+		Key:         "id",
+		Timeout:     time.Minute,
+		MaxPending:  maxPending,
+	}, fanout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+func (s *recordingSink) Write(bp client.BatchPoints) error {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, pt := range bp.Points() {
+		s.points = append(s.points, pt.String())
+	}
+
+	return nil
+}
+
+func (s *recordingSink) Close() error {
+	return nil
+}
+
+// check compares the written points with the expected ones.
+func (s *recordingSink) check(t *testing.T, expected ...string) {
+	t.Helper()
+	s.Lock()
+	defer s.Unlock()
+
+	if !reflect.DeepEqual(s.points, expected) {
+		t.Errorf("expected points %q, got %q", expected, s.points)
+	}
+}
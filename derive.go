@@ -0,0 +1,155 @@
+package main
+
+// sysflux
+// Copyright (C) 2018 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/mcuadros/go-syslog.v2/format"
+)
+
+// --------------------------------------------------------------------------------------
+//  constants
+// --------------------------------------------------------------------------------------
+
+const (
+	PrefixSyslog = "syslog."
+)
+
+// syslog header fields which are accessible from expressions
+var syslogHeaderFields = []string{
+	"hostname", "tag", "priority", "facility", "severity", "client",
+}
+
+// ---------------------------------------------------------------------------------------
+//  types
+// ---------------------------------------------------------------------------------------
+
+// Derived is a tag or field which is computed from the
+// captures of a log message.
+type Derived struct {
+	Name string
+	Tag  bool
+	Expr *Expr
+}
+
+// ---------------------------------------------------------------------------------------
+//  private members
+// ---------------------------------------------------------------------------------------
+
+// compileDerived compiles the expressions of all configured derived
+// tags and fields. Every expression may reference the capture groups,
+// the syslog header fields and all previously derived names.
+func (r *Recorder) compileDerived() error {
+	// only tags and values are part of the evaluation environment
+	known := make(map[string]bool)
+	for _, name := range r.matcher.SubexpNames() {
+		switch {
+		case strings.HasPrefix(name, PrefixTag):
+			known[strings.TrimPrefix(name, PrefixTag)] = true
+		case strings.HasPrefix(name, PrefixValue):
+			known[strings.TrimPrefix(name, PrefixValue)] = true
+		}
+	}
+	for _, name := range syslogHeaderFields {
+		known[PrefixSyslog+name] = true
+	}
+
+	r.derived = make([]Derived, 0, len(r.Conf.Derive))
+	for i, conf := range r.Conf.Derive {
+		if (conf.Tag == "") == (conf.Field == "") {
+			return fmt.Errorf("derive(%d): exactly one of tag or field must be set", i)
+		}
+
+		expr, err := CompileExpr(conf.Expr, known)
+		if err != nil {
+			return errors.New("derive(" + conf.Tag + conf.Field + "): " + err.Error())
+		}
+
+		derived := Derived{Name: conf.Field, Tag: conf.Tag != "", Expr: expr}
+		if derived.Tag {
+			derived.Name = conf.Tag
+		}
+		known[derived.Name] = true
+
+		r.derived = append(r.derived, derived)
+	}
+
+	return nil
+}
+
+// derive evaluates all derived tags and fields and adds
+// the results to the given tags and values.
+func (r *Recorder) derive(message format.LogParts, tags Tags, values Values) {
+	if len(r.derived) < 1 {
+		return
+	}
+
+	// construct the environment for expression evaluation
+	env := make(Env, len(tags)+len(values)+len(syslogHeaderFields))
+	for _, name := range syslogHeaderFields {
+		if v, ok := message[name]; ok {
+			env[PrefixSyslog+name] = normalizeEnvValue(v)
+		}
+	}
+	for k, v := range tags {
+		env[k] = v
+	}
+	for k, v := range values {
+		env[k] = normalizeEnvValue(v)
+	}
+
+	for _, derived := range r.derived {
+		v, err := derived.Expr.Eval(env)
+		if err != nil {
+			logrus.Debugf("failed to derive %s: %s", derived.Name, err.Error())
+			continue
+		}
+		env[derived.Name] = v
+
+		if derived.Tag {
+			tags[derived.Name] = toString(v)
+		} else {
+			values[derived.Name] = v
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------------------
+//  private functions
+// ---------------------------------------------------------------------------------------
+
+// normalizeEnvValue converts numbers to float64 as expected by expressions.
+func normalizeEnvValue(v interface{}) interface{} {
+	switch v.(type) {
+	case string, bool, float64:
+		return v
+	}
+
+	if n, err := toNumber(v); err == nil {
+		return n
+	}
+
+	return toString(v)
+}
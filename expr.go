@@ -0,0 +1,792 @@
+package main
+
+// sysflux
+// Copyright (C) 2018 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// ---------------------------------------------------------------------------------------
+//  types
+// ---------------------------------------------------------------------------------------
+
+// Expr is a compiled expression which is evaluated against
+// the tags, values and syslog header of a single log message.
+//
+// Supported are number, string and boolean literals, identifiers,
+// the arithmetic operators + - * / %, the comparison operators
+// == != < <= > >=, regex matching with =~ and !~, the logical
+// operators && || !, the ternary operator c ? a : b and a fixed
+// set of builtin functions (see exprFuncs).
+type Expr struct {
+	Source string
+
+	eval evalFunc
+}
+
+// Env holds the variables an expression is evaluated against.
+// Values are either float64, string or bool.
+type Env map[string]interface{}
+
+type evalFunc func(env Env) (interface{}, error)
+
+type exprFunc struct {
+	minArgs int
+	maxArgs int
+	call    func(args []interface{}) (interface{}, error)
+}
+
+type token struct {
+	kind string
+	text string
+	pos  int
+}
+
+type exprParser struct {
+	tokens []token
+	pos    int
+	known  map[string]bool
+}
+
+// ---------------------------------------------------------------------------------------
+//  constants
+// ---------------------------------------------------------------------------------------
+
+const (
+	tokEOF    = "EOF"
+	tokNumber = "number"
+	tokString = "string"
+	tokIdent  = "ident"
+	tokOp     = "op"
+)
+
+// operators ordered such that longer operators are matched first
+var exprOperators = []string{
+	"&&", "||", "==", "!=", "<=", ">=", "=~", "!~",
+	"+", "-", "*", "/", "%", "<", ">", "!", "(", ")", ",", "?", ":",
+}
+
+// ---------------------------------------------------------------------------------------
+//  builtin functions
+// ---------------------------------------------------------------------------------------
+
+var exprFuncs = map[string]exprFunc{
+	"num": {1, 1, func(args []interface{}) (interface{}, error) {
+		return toNumber(args[0])
+	}},
+	"str": {1, 1, func(args []interface{}) (interface{}, error) {
+		return toString(args[0]), nil
+	}},
+	"lower": {1, 1, func(args []interface{}) (interface{}, error) {
+		return strings.ToLower(toString(args[0])), nil
+	}},
+	"upper": {1, 1, func(args []interface{}) (interface{}, error) {
+		return strings.ToUpper(toString(args[0])), nil
+	}},
+	"len": {1, 1, func(args []interface{}) (interface{}, error) {
+		return float64(len(toString(args[0]))), nil
+	}},
+	"substr": {2, 3, func(args []interface{}) (interface{}, error) {
+		s := toString(args[0])
+		start, err := toNumber(args[1])
+		if err != nil {
+			return nil, err
+		}
+		from := clamp(int(start), 0, len(s))
+		to := len(s)
+		if len(args) > 2 {
+			n, err := toNumber(args[2])
+			if err != nil {
+				return nil, err
+			}
+			to = clamp(from+int(n), from, len(s))
+		}
+		return s[from:to], nil
+	}},
+	"contains": {2, 2, func(args []interface{}) (interface{}, error) {
+		return strings.Contains(toString(args[0]), toString(args[1])), nil
+	}},
+	"prefix": {2, 2, func(args []interface{}) (interface{}, error) {
+		return strings.HasPrefix(toString(args[0]), toString(args[1])), nil
+	}},
+	"suffix": {2, 2, func(args []interface{}) (interface{}, error) {
+		return strings.HasSuffix(toString(args[0]), toString(args[1])), nil
+	}},
+	"abs":   mathFunc(math.Abs),
+	"floor": mathFunc(math.Floor),
+	"ceil":  mathFunc(math.Ceil),
+	"round": mathFunc(math.Round),
+	"min": {2, 2, func(args []interface{}) (interface{}, error) {
+		a, b, err := toNumbers(args[0], args[1])
+		return math.Min(a, b), err
+	}},
+	"max": {2, 2, func(args []interface{}) (interface{}, error) {
+		a, b, err := toNumbers(args[0], args[1])
+		return math.Max(a, b), err
+	}},
+}
+
+// ---------------------------------------------------------------------------------------
+//  public functions
+// ---------------------------------------------------------------------------------------
+
+// CompileExpr parses the given expression. All identifiers used in
+// the expression must be contained in known, otherwise an error is returned.
+func CompileExpr(src string, known map[string]bool) (*Expr, error) {
+	tokens, err := tokenize(src)
+	if err != nil {
+		return nil, err
+	}
+
+	p := exprParser{tokens: tokens, known: known}
+	eval, err := p.parseTernary()
+	if err != nil {
+		return nil, err
+	}
+
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, fmt.Errorf("unexpected %q at position %d", tok.text, tok.pos)
+	}
+
+	return &Expr{Source: src, eval: eval}, nil
+}
+
+// Eval evaluates the expression against the given environment.
+func (e *Expr) Eval(env Env) (interface{}, error) {
+	return e.eval(env)
+}
+
+// ---------------------------------------------------------------------------------------
+//  private functions: lexer
+// ---------------------------------------------------------------------------------------
+
+// tokenize splits the expression source into tokens.
+func tokenize(src string) ([]token, error) {
+	tokens := make([]token, 0)
+
+	for i := 0; i < len(src); {
+		c := rune(src[i])
+
+		switch {
+		case unicode.IsSpace(c):
+			i++
+
+		case unicode.IsDigit(c) || (c == '.' && i+1 < len(src) && unicode.IsDigit(rune(src[i+1]))):
+			start := i
+			for i < len(src) && (unicode.IsDigit(rune(src[i])) || src[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, token{tokNumber, src[start:i], start})
+
+		case unicode.IsLetter(c) || c == '_':
+			start := i
+			for i < len(src) && isIdentChar(rune(src[i])) {
+				i++
+			}
+			tokens = append(tokens, token{tokIdent, src[start:i], start})
+
+		case c == '"' || c == '\'':
+			start := i
+			i++
+			for i < len(src) && rune(src[i]) != c {
+				if src[i] == '\\' {
+					i++
+				}
+				i++
+			}
+			if i >= len(src) {
+				return nil, fmt.Errorf("unterminated string at position %d", start)
+			}
+			i++
+
+			// single quoted strings are taken literally
+			text := src[start+1 : i-1]
+			if c == '"' {
+				var err error
+				text, err = strconv.Unquote(src[start:i])
+				if err != nil {
+					return nil, fmt.Errorf("invalid string at position %d: %s", start, err.Error())
+				}
+			}
+			tokens = append(tokens, token{tokString, text, start})
+
+		default:
+			op := ""
+			for _, o := range exprOperators {
+				if strings.HasPrefix(src[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected character %q at position %d", c, i)
+			}
+			tokens = append(tokens, token{tokOp, op, i})
+			i += len(op)
+		}
+	}
+
+	return append(tokens, token{tokEOF, "end of expression", len(src)}), nil
+}
+
+// isIdentChar returns true if the rune is allowed inside of an identifier.
+func isIdentChar(c rune) bool {
+	return unicode.IsLetter(c) || unicode.IsDigit(c) || c == '_' || c == '.'
+}
+
+// ---------------------------------------------------------------------------------------
+//  private members: parser
+// ---------------------------------------------------------------------------------------
+
+func (p *exprParser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *exprParser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+// accept consumes the next token if it is one of the given operators.
+func (p *exprParser) accept(ops ...string) (string, bool) {
+	tok := p.peek()
+	if tok.kind != tokOp {
+		return "", false
+	}
+
+	for _, op := range ops {
+		if tok.text == op {
+			p.pos++
+			return op, true
+		}
+	}
+
+	return "", false
+}
+
+func (p *exprParser) expect(op string) error {
+	if _, ok := p.accept(op); !ok {
+		tok := p.peek()
+		return fmt.Errorf("expected %q at position %d, got %q", op, tok.pos, tok.text)
+	}
+	return nil
+}
+
+func (p *exprParser) parseTernary() (evalFunc, error) {
+	cond, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := p.accept("?"); !ok {
+		return cond, nil
+	}
+
+	then, err := p.parseTernary()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+	otherwise, err := p.parseTernary()
+	if err != nil {
+		return nil, err
+	}
+
+	return func(env Env) (interface{}, error) {
+		c, err := evalBool(cond, env)
+		if err != nil {
+			return nil, err
+		}
+		if c {
+			return then(env)
+		}
+		return otherwise(env)
+	}, nil
+}
+
+func (p *exprParser) parseOr() (evalFunc, error) {
+	lhs, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		if _, ok := p.accept("||"); !ok {
+			return lhs, nil
+		}
+		rhs, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		lhs = logical(lhs, rhs, true)
+	}
+}
+
+func (p *exprParser) parseAnd() (evalFunc, error) {
+	lhs, err := p.parseCompare()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		if _, ok := p.accept("&&"); !ok {
+			return lhs, nil
+		}
+		rhs, err := p.parseCompare()
+		if err != nil {
+			return nil, err
+		}
+		lhs = logical(lhs, rhs, false)
+	}
+}
+
+func (p *exprParser) parseCompare() (evalFunc, error) {
+	lhs, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+
+	// regex matches need a string literal on the right hand side,
+	// which is compiled once at startup
+	if op, ok := p.accept("=~", "!~"); ok {
+		tok := p.next()
+		if tok.kind != tokString {
+			return nil, fmt.Errorf("expected regex string at position %d", tok.pos)
+		}
+		re, err := regexp.Compile(tok.text)
+		if err != nil {
+			return nil, err
+		}
+		return func(env Env) (interface{}, error) {
+			v, err := lhs(env)
+			if err != nil {
+				return nil, err
+			}
+			return re.MatchString(toString(v)) == (op == "=~"), nil
+		}, nil
+	}
+
+	op, ok := p.accept("==", "!=", "<", "<=", ">", ">=")
+	if !ok {
+		return lhs, nil
+	}
+
+	rhs, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+
+	return func(env Env) (interface{}, error) {
+		a, b, err := evalBoth(lhs, rhs, env)
+		if err != nil {
+			return nil, err
+		}
+		return compare(op, a, b)
+	}, nil
+}
+
+func (p *exprParser) parseAdditive() (evalFunc, error) {
+	lhs, err := p.parseMultiplicative()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		op, ok := p.accept("+", "-")
+		if !ok {
+			return lhs, nil
+		}
+		rhs, err := p.parseMultiplicative()
+		if err != nil {
+			return nil, err
+		}
+		lhs = arithmetic(op, lhs, rhs)
+	}
+}
+
+func (p *exprParser) parseMultiplicative() (evalFunc, error) {
+	lhs, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		op, ok := p.accept("*", "/", "%")
+		if !ok {
+			return lhs, nil
+		}
+		rhs, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		lhs = arithmetic(op, lhs, rhs)
+	}
+}
+
+func (p *exprParser) parseUnary() (evalFunc, error) {
+	op, ok := p.accept("!", "-")
+	if !ok {
+		return p.parsePrimary()
+	}
+
+	operand, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	if op == "!" {
+		return func(env Env) (interface{}, error) {
+			v, err := evalBool(operand, env)
+			return !v, err
+		}, nil
+	}
+
+	return func(env Env) (interface{}, error) {
+		v, err := operand(env)
+		if err != nil {
+			return nil, err
+		}
+		n, err := toNumber(v)
+		return -n, err
+	}, nil
+}
+
+func (p *exprParser) parsePrimary() (evalFunc, error) {
+	tok := p.next()
+
+	switch tok.kind {
+	case tokNumber:
+		n, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q at position %d", tok.text, tok.pos)
+		}
+		return constant(n), nil
+
+	case tokString:
+		return constant(tok.text), nil
+
+	case tokIdent:
+		if tok.text == "true" || tok.text == "false" {
+			return constant(tok.text == "true"), nil
+		}
+
+		if _, ok := p.accept("("); ok {
+			return p.parseCall(tok)
+		}
+
+		if !p.known[tok.text] {
+			return nil, fmt.Errorf("unknown identifier %q at position %d", tok.text, tok.pos)
+		}
+
+		name := tok.text
+		return func(env Env) (interface{}, error) {
+			v, ok := env[name]
+			if !ok {
+				return nil, fmt.Errorf("%s is not set", name)
+			}
+			return v, nil
+		}, nil
+
+	case tokOp:
+		if tok.text == "(" {
+			inner, err := p.parseTernary()
+			if err != nil {
+				return nil, err
+			}
+			return inner, p.expect(")")
+		}
+	}
+
+	return nil, fmt.Errorf("unexpected %q at position %d", tok.text, tok.pos)
+}
+
+// parseCall parses the argument list of a builtin function call.
+func (p *exprParser) parseCall(name token) (evalFunc, error) {
+	fn, ok := exprFuncs[name.text]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %q at position %d", name.text, name.pos)
+	}
+
+	args := make([]evalFunc, 0)
+	if _, ok := p.accept(")"); !ok {
+		for {
+			arg, err := p.parseTernary()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+
+			if _, ok := p.accept(","); !ok {
+				break
+			}
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(args) < fn.minArgs || len(args) > fn.maxArgs {
+		return nil, fmt.Errorf("wrong number of arguments for %s() at position %d", name.text, name.pos)
+	}
+
+	return func(env Env) (interface{}, error) {
+		values := make([]interface{}, len(args))
+		for i, arg := range args {
+			v, err := arg(env)
+			if err != nil {
+				return nil, err
+			}
+			values[i] = v
+		}
+		return fn.call(values)
+	}, nil
+}
+
+// ---------------------------------------------------------------------------------------
+//  private functions: evaluation
+// ---------------------------------------------------------------------------------------
+
+func constant(v interface{}) evalFunc {
+	return func(Env) (interface{}, error) {
+		return v, nil
+	}
+}
+
+func logical(lhs, rhs evalFunc, or bool) evalFunc {
+	return func(env Env) (interface{}, error) {
+		a, err := evalBool(lhs, env)
+		if err != nil {
+			return nil, err
+		}
+
+		// short circuit evaluation
+		if a == or {
+			return a, nil
+		}
+		return evalBool(rhs, env)
+	}
+}
+
+func arithmetic(op string, lhs, rhs evalFunc) evalFunc {
+	return func(env Env) (interface{}, error) {
+		a, b, err := evalBoth(lhs, rhs, env)
+		if err != nil {
+			return nil, err
+		}
+
+		// the plus operator concatenates if any operand is a string
+		_, aStr := a.(string)
+		_, bStr := b.(string)
+		if op == "+" && (aStr || bStr) {
+			return toString(a) + toString(b), nil
+		}
+
+		x, y, err := toNumbers(a, b)
+		if err != nil {
+			return nil, err
+		}
+
+		switch op {
+		case "+":
+			return x + y, nil
+		case "-":
+			return x - y, nil
+		case "*":
+			return x * y, nil
+		case "/":
+			if y == 0 {
+				return nil, errors.New("division by zero")
+			}
+			return x / y, nil
+		default:
+			if y == 0 {
+				return nil, errors.New("division by zero")
+			}
+			return math.Mod(x, y), nil
+		}
+	}
+}
+
+func compare(op string, a, b interface{}) (interface{}, error) {
+	// two strings are compared lexically, a string and a
+	// number are compared numerically
+	as, aStr := a.(string)
+	bs, bStr := b.(string)
+	if aStr && bStr {
+		switch op {
+		case "==":
+			return as == bs, nil
+		case "!=":
+			return as != bs, nil
+		case "<":
+			return as < bs, nil
+		case "<=":
+			return as <= bs, nil
+		case ">":
+			return as > bs, nil
+		default:
+			return as >= bs, nil
+		}
+	}
+
+	// booleans can only be compared for equality
+	ab, aBool := a.(bool)
+	bb, bBool := b.(bool)
+	if aBool || bBool {
+		if !aBool || !bBool || (op != "==" && op != "!=") {
+			return nil, fmt.Errorf("invalid comparison of %T with %T", a, b)
+		}
+		return (ab == bb) == (op == "=="), nil
+	}
+
+	x, y, err := toNumbers(a, b)
+	if err != nil {
+		return nil, err
+	}
+
+	switch op {
+	case "==":
+		return x == y, nil
+	case "!=":
+		return x != y, nil
+	case "<":
+		return x < y, nil
+	case "<=":
+		return x <= y, nil
+	case ">":
+		return x > y, nil
+	default:
+		return x >= y, nil
+	}
+}
+
+func evalBoth(lhs, rhs evalFunc, env Env) (interface{}, interface{}, error) {
+	a, err := lhs(env)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	b, err := rhs(env)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return a, b, nil
+}
+
+func evalBool(fn evalFunc, env Env) (bool, error) {
+	v, err := fn(env)
+	if err != nil {
+		return false, err
+	}
+
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("expected bool, got %T", v)
+	}
+
+	return b, nil
+}
+
+func mathFunc(fn func(float64) float64) exprFunc {
+	return exprFunc{1, 1, func(args []interface{}) (interface{}, error) {
+		n, err := toNumber(args[0])
+		return fn(n), err
+	}}
+}
+
+// ---------------------------------------------------------------------------------------
+//  private functions: conversion
+// ---------------------------------------------------------------------------------------
+
+func toNumber(v interface{}) (float64, error) {
+	switch n := v.(type) {
+	case float64:
+		return n, nil
+	case float32:
+		return float64(n), nil
+	case int:
+		return float64(n), nil
+	case int64:
+		return float64(n), nil
+	case bool:
+		if n {
+			return 1, nil
+		}
+		return 0, nil
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(n), 64)
+		if err != nil {
+			return 0, fmt.Errorf("%q is not a number", n)
+		}
+		return f, nil
+	}
+
+	return 0, fmt.Errorf("%T is not a number", v)
+}
+
+func toNumbers(a, b interface{}) (float64, float64, error) {
+	x, err := toNumber(a)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	y, err := toNumber(b)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return x, y, nil
+}
+
+func toString(v interface{}) string {
+	switch s := v.(type) {
+	case string:
+		return s
+	case float64:
+		return strconv.FormatFloat(s, 'f', -1, 64)
+	case float32:
+		return strconv.FormatFloat(float64(s), 'f', -1, 32)
+	}
+
+	return fmt.Sprint(v)
+}
+
+func clamp(v, min, max int) int {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
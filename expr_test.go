@@ -0,0 +1,217 @@
+package main
+
+// sysflux
+// Copyright (C) 2018 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"strings"
+	"testing"
+)
+
+// ---------------------------------------------------------------------------------------
+//  tests
+// ---------------------------------------------------------------------------------------
+
+func TestExprEval(t *testing.T) {
+	env := Env{
+		"duration":        1.5,
+		"status":          "404",
+		"path":            "/api/Users",
+		"ok":              true,
+		"syslog.hostname": "web01",
+	}
+
+	tests := []struct {
+		expr     string
+		expected interface{}
+	}{
+		// precedence and associativity
+		{"1 + 2 * 3", 7.0},
+		{"(1 + 2) * 3", 9.0},
+		{"10 - 4 - 3", 3.0},
+		{"24 / 4 / 2", 3.0},
+		{"7 % 4 * 2", 6.0},
+		{"-2 * 3", -6.0},
+		{"--2", 2.0},
+		{"1 + 2 < 4", true},
+		{"(1 < 2) == true", true},
+		{"true || false && false", true},
+		{"(true || false) && false", false},
+		{"!ok || duration > 1", true},
+		{"!(1 < 2)", false},
+
+		// ternary operator
+		{"duration > 1 ? 'slow' : 'fast'", "slow"},
+		{"duration > 2 ? 'slow' : 'fast'", "fast"},
+		{"status >= 500 ? 'error' : status >= 400 ? 'client' : 'ok'", "client"},
+		{"ok ? 1 + 1 : 0", 2.0},
+
+		// string and number coercion
+		{"status + 1", "4041"},
+		{"status - 4", 400.0},
+		{"status * 1", 404.0},
+		{"status == 404", true},
+		{"status == '404'", true},
+		{"'10' < '9'", true},
+		{"'10' < 9", false},
+		{"duration + ' s'", "1.5 s"},
+		{"ok + 1", 2.0},
+		{"ok == true", true},
+
+		// regex matching
+		{"path =~ '^/api/'", true},
+		{"path !~ '(?i)users'", false},
+
+		// variables
+		{"syslog.hostname", "web01"},
+		{"duration", 1.5},
+
+		// builtin functions
+		{"num(' 42 ')", 42.0},
+		{"str(1.25)", "1.25"},
+		{"lower(path)", "/api/users"},
+		{"upper('abc')", "ABC"},
+		{"len(path)", 10.0},
+		{"substr(path, 5)", "Users"},
+		{"substr(path, 1, 3)", "api"},
+		{"substr(path, 8, 10)", "rs"},
+		{"substr(path, -1, 2)", "/a"},
+		{"contains(path, 'Use')", true},
+		{"prefix(path, '/api')", true},
+		{"suffix(path, 'x')", false},
+		{"abs(-2.5)", 2.5},
+		{"floor(2.7)", 2.0},
+		{"ceil(2.1)", 3.0},
+		{"round(2.5)", 3.0},
+		{"min(duration, 1)", 1.0},
+		{"max(status, 500)", 500.0},
+	}
+
+	for _, test := range tests {
+		expr, err := CompileExpr(test.expr, exprKnown(env))
+		if err != nil {
+			t.Errorf("%s: %s", test.expr, err.Error())
+			continue
+		}
+
+		v, err := expr.Eval(env)
+		if err != nil {
+			t.Errorf("%s: %s", test.expr, err.Error())
+			continue
+		}
+		if v != test.expected {
+			t.Errorf("%s: expected %#v, got %#v", test.expr, test.expected, v)
+		}
+	}
+}
+
+func TestExprEvalErrors(t *testing.T) {
+	env := Env{"zero": 0.0, "name": "abc", "missing": 1.0}
+
+	tests := []struct {
+		expr string
+		err  string
+	}{
+		{"1 / zero", "division by zero"},
+		{"1 % 0", "division by zero"},
+		{"name * 2", "is not a number"},
+		{"num(name)", "is not a number"},
+		{"true < false", "invalid comparison"},
+		{"true == 1", "invalid comparison"},
+		{"1 && true", "expected bool"},
+		{"name ? 1 : 2", "expected bool"},
+		{"unset + 1", "unset is not set"},
+	}
+
+	known := exprKnown(env)
+	known["unset"] = true
+
+	for _, test := range tests {
+		expr, err := CompileExpr(test.expr, known)
+		if err != nil {
+			t.Errorf("%s: %s", test.expr, err.Error())
+			continue
+		}
+
+		_, err = expr.Eval(env)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: expected error %q, got %v", test.expr, test.err, err)
+		}
+	}
+}
+
+func TestExprShortCircuit(t *testing.T) {
+	// the right operand is never evaluated, so the missing value does not fail
+	for _, src := range []string{"true || unset > 1", "false && unset > 1", "true ? 1 : unset"} {
+		expr, err := CompileExpr(src, map[string]bool{"unset": true})
+		if err != nil {
+			t.Fatalf("%s: %s", src, err.Error())
+		}
+
+		_, err = expr.Eval(Env{})
+		if err != nil {
+			t.Errorf("%s: %s", src, err.Error())
+		}
+	}
+}
+
+func TestExprCompileErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		err  string
+	}{
+		{"unknown + 1", `unknown identifier "unknown"`},
+		{"foo(1)", `unknown function "foo"`},
+		{"lower()", "wrong number of arguments for lower()"},
+		{"substr('a', 1, 2, 3)", "wrong number of arguments for substr()"},
+		{"1 +", "unexpected"},
+		{"(1 + 2", `expected ")"`},
+		{"1 2", `unexpected "2"`},
+		{"1 < 2 == true", `unexpected "=="`},
+		{"known ? 1", `expected ":"`},
+		{"'abc", "unterminated string"},
+		{`"\q"`, "invalid string"},
+		{"1 # 2", "unexpected character"},
+		{"1.2.3", "invalid number"},
+		{"known =~ known", "expected regex string"},
+		{"known =~ '('", "error parsing regexp"},
+	}
+
+	for _, test := range tests {
+		_, err := CompileExpr(test.expr, map[string]bool{"known": true})
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: expected error %q, got %v", test.expr, test.err, err)
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------------------
+//  helpers
+// ---------------------------------------------------------------------------------------
+
+// exprKnown returns the names of the environment.
+func exprKnown(env Env) map[string]bool {
+	known := make(map[string]bool, len(env))
+	for name := range env {
+		known[name] = true
+	}
+
+	return known
+}
@@ -0,0 +1,110 @@
+package main
+
+// sysflux
+// Copyright (C) 2018 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// --------------------------------------------------------------------------------------
+//  constants
+// --------------------------------------------------------------------------------------
+
+const (
+	// match key of the measurement name
+	MatchMeasurement = "measurement"
+)
+
+// ---------------------------------------------------------------------------------------
+//  types
+// ---------------------------------------------------------------------------------------
+
+// Fanout distributes points to the routers of all outputs
+// whose match conditions are satisfied.
+type Fanout struct {
+	outputs []*fanoutOutput
+}
+
+type fanoutOutput struct {
+	name   string
+	match  map[string]string
+	router *Router
+}
+
+// ---------------------------------------------------------------------------------------
+//  public members
+// ---------------------------------------------------------------------------------------
+
+// AddOutput registers the router of an output. Points are passed to the
+// router if all match conditions are equal to the variables of the point.
+func (f *Fanout) AddOutput(name string, match map[string]string, router *Router) {
+	f.outputs = append(f.outputs, &fanoutOutput{name, match, router})
+}
+
+// Add passes the point to all matching outputs. A failing output
+// does not prevent the point from being passed to the others.
+func (f *Fanout) Add(vars map[string]string, measurement string, timestamp time.Time, tags Tags, values Values) error {
+	var errs []string
+	for _, output := range f.outputs {
+		if !output.matches(vars, measurement) {
+			continue
+		}
+
+		err := output.router.Add(vars, measurement, timestamp, tags, values)
+		if err != nil {
+			errs = append(errs, OutputName(output.name)+": "+err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+// Close writes the pending points of all outputs.
+func (f *Fanout) Close() {
+	for _, output := range f.outputs {
+		output.router.Close()
+	}
+}
+
+// ---------------------------------------------------------------------------------------
+//  private members
+// ---------------------------------------------------------------------------------------
+
+// matches returns true if the point satisfies the match conditions.
+func (o *fanoutOutput) matches(vars map[string]string, measurement string) bool {
+	for k, v := range o.match {
+		if k == MatchMeasurement {
+			if measurement != v {
+				return false
+			}
+		} else if vars[k] != v {
+			return false
+		}
+	}
+
+	return true
+}
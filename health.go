@@ -0,0 +1,172 @@
+package main
+
+// sysflux
+// Copyright (C) 2018 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"errors"
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// --------------------------------------------------------------------------------------
+//  constants
+// --------------------------------------------------------------------------------------
+
+const (
+	StartupContinue = "continue"
+	StartupWait     = "wait"
+	StartupFail     = "fail"
+)
+
+// ---------------------------------------------------------------------------------------
+//  types
+// ---------------------------------------------------------------------------------------
+
+// Pinger is implemented by sinks which can check the availability
+// of their backend, like every influxdb client.Client.
+type Pinger interface {
+	Ping(timeout time.Duration) (time.Duration, string, error)
+}
+
+// HealthCheck periodically pings the backend of an output. The health is
+// logged when it changes and published in the "health" map of the expvar
+// endpoint as 1 (healthy) or 0 (unhealthy).
+type HealthCheck struct {
+	Name     string
+	Pinger   Pinger
+	Interval time.Duration
+	Timeout  time.Duration
+
+	// internal variables
+	healthy bool
+	checked bool
+	metric  *expvar.Int
+	done    chan struct{}
+	stopped chan struct{}
+	sync.Mutex
+}
+
+// ---------------------------------------------------------------------------------------
+//  public functions
+// ---------------------------------------------------------------------------------------
+
+// NewHealthCheck creates a new health check, which is started
+// by Startup. Outputs are unhealthy until the first check.
+func NewHealthCheck(name string, pinger Pinger, interval, timeout time.Duration) *HealthCheck {
+	h := HealthCheck{
+		Name:     name,
+		Pinger:   pinger,
+		Interval: interval,
+		Timeout:  timeout,
+		metric:   new(expvar.Int),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	healthStats.Set(name, h.metric)
+
+	return &h
+}
+
+// ---------------------------------------------------------------------------------------
+//  public members
+// ---------------------------------------------------------------------------------------
+
+// Startup checks the health of the output according to the startup mode
+// and starts the periodic checks afterwards. With "wait" it blocks until
+// the output is healthy, with "fail" an unhealthy output is an error and
+// with "continue" the output is used degraded.
+func (h *HealthCheck) Startup(mode string) error {
+	err := h.Check()
+	if err != nil {
+		switch mode {
+		case StartupFail:
+			return errors.New("unhealthy: " + err.Error())
+
+		case StartupWait:
+			for err != nil {
+				logrus.Infof("%s: waiting for the output, checking again in %s", h.Name, h.Interval)
+				time.Sleep(h.Interval)
+				err = h.Check()
+			}
+
+		default:
+			logrus.Warnf("%s: continuing with unhealthy output", h.Name)
+		}
+	}
+
+	go h.run()
+	return nil
+}
+
+// Check pings the backend and updates the health.
+func (h *HealthCheck) Check() error {
+	_, _, err := h.Pinger.Ping(h.Timeout)
+
+	h.Lock()
+	defer h.Unlock()
+
+	healthy := err == nil
+	if h.checked && healthy == h.healthy {
+		return err
+	}
+
+	h.checked = true
+	h.healthy = healthy
+	if healthy {
+		h.metric.Set(1)
+		logrus.Infof("%s: output is healthy", h.Name)
+	} else {
+		h.metric.Set(0)
+		logrus.Warnf("%s: output is unhealthy: %s", h.Name, err.Error())
+	}
+
+	return err
+}
+
+// Stop stops the periodic checks.
+func (h *HealthCheck) Stop() {
+	close(h.done)
+	<-h.stopped
+}
+
+// ---------------------------------------------------------------------------------------
+//  private members
+// ---------------------------------------------------------------------------------------
+
+// run checks the health in the configured interval.
+func (h *HealthCheck) run() {
+	defer close(h.stopped)
+
+	ticker := time.NewTicker(h.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.done:
+			return
+		case <-ticker.C:
+			h.Check()
+		}
+	}
+}
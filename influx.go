@@ -0,0 +1,409 @@
+package main
+
+// sysflux
+// Copyright (C) 2018 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+// --------------------------------------------------------------------------------------
+//  constants
+// --------------------------------------------------------------------------------------
+
+const (
+	ApiV1 = "v1"
+	ApiV2 = "v2"
+
+	ProtocolHTTP = "http"
+	ProtocolUDP  = "udp"
+
+	UserAgent = "sysflux"
+)
+
+// ---------------------------------------------------------------------------------------
+//  types
+// ---------------------------------------------------------------------------------------
+
+// influxV1 is a client for InfluxDB 1.x. Writes are compressed and split
+// by the maximum body size if configured, all other requests are
+// executed by the influxdb client.
+type influxV1 struct {
+	client.Client
+
+	// internal variables
+	url         url.URL
+	user        string
+	password    string
+	gzip        bool
+	maxBodySize int
+	httpClient  *http.Client
+	transport   *http.Transport
+}
+
+// influxV2 is a client for the write api of InfluxDB 2.x and 3.x.
+type influxV2 struct {
+	url         url.URL
+	org         string
+	token       string
+	gzip        bool
+	maxBodySize int
+	httpClient  *http.Client
+	transport   *http.Transport
+}
+
+// ---------------------------------------------------------------------------------------
+//  public functions
+// ---------------------------------------------------------------------------------------
+
+// NewInfluxClient creates a new influxdb client speaking the configured
+// protocol and api version. If requested, missing databases are created.
+func NewInfluxClient(conf *ConfInflux, timeout time.Duration) (client.Client, error) {
+	// batches are split into packets of at most the payload size
+	if conf.Protocol == ProtocolUDP {
+		return client.NewUDPClient(client.UDPConfig{
+			Addr:        conf.Addr,
+			PayloadSize: conf.PayloadSize,
+		})
+	}
+
+	switch conf.Api {
+	case "", ApiV1:
+		c, err := newInfluxV1(conf, timeout)
+		if err != nil {
+			return nil, err
+		}
+		if conf.CreateDatabase {
+			return newProvisioner(c, conf.Addr, conf), nil
+		}
+		return c, nil
+
+	case ApiV2:
+		return newInfluxV2(conf, timeout)
+	}
+
+	return nil, errors.New("unsupported influxdb api \"" + conf.Api + "\"")
+}
+
+// ---------------------------------------------------------------------------------------
+//  private functions
+// ---------------------------------------------------------------------------------------
+
+// lineProtocolPrecision converts the precision to the notation
+// understood when formatting the timestamps of points.
+func lineProtocolPrecision(precision string) string {
+	switch precision {
+	case "ns":
+		return "n"
+	case "us":
+		return "u"
+	}
+
+	return precision
+}
+
+// splitLines formats the points in the line protocol and splits them into
+// bodies of at most maxSize bytes. A point exceeding the maximum size on
+// its own is put into a separate body. A maxSize of 0 disables splitting.
+func splitLines(points []*client.Point, precision string, maxSize int) [][]byte {
+	bodies := make([][]byte, 0, 1)
+	var body bytes.Buffer
+	for _, p := range points {
+		line := p.PrecisionString(precision) + "\n"
+		if maxSize > 0 && body.Len() > 0 && body.Len()+len(line) > maxSize {
+			bodies = append(bodies, append([]byte(nil), body.Bytes()...))
+			body.Reset()
+		}
+		body.WriteString(line)
+	}
+
+	if body.Len() > 0 {
+		bodies = append(bodies, body.Bytes())
+	}
+
+	return bodies
+}
+
+// newWriteRequest creates a write request for the body,
+// which is compressed with gzip if requested.
+func newWriteRequest(u string, body []byte, compress bool) (*http.Request, error) {
+	if compress {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		_, err := w.Write(body)
+		if err == nil {
+			err = w.Close()
+		}
+		if err != nil {
+			return nil, err
+		}
+		body = buf.Bytes()
+	}
+
+	req, err := http.NewRequest("POST", u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	req.Header.Set("User-Agent", UserAgent)
+	if compress {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+
+	return req, nil
+}
+
+// checkResponse returns an error if the request failed. Rejected
+// points are not worth a retry, other errors like a missing
+// database might be fixed in the meantime.
+func checkResponse(resp *http.Response) error {
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+
+	err = fmt.Errorf("influxdb responded with %s: %s",
+		resp.Status, strings.TrimSpace(string(body)))
+
+	switch resp.StatusCode {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity:
+		return PermanentError{err}
+	}
+
+	return err
+}
+
+// newInfluxV1 creates a new client for InfluxDB 1.x.
+func newInfluxV1(conf *ConfInflux, timeout time.Duration) (*influxV1, error) {
+	transport, err := NewHTTPTransport(&conf.TLS, conf.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := client.NewHTTPClient(client.HTTPConfig{
+		Addr:      conf.Addr,
+		Username:  conf.User,
+		Password:  conf.Password,
+		Timeout:   timeout,
+		TLSConfig: transport.TLSClientConfig,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// the address has been validated by the influxdb client
+	u, _ := url.Parse(conf.Addr)
+
+	return &influxV1{
+		Client:      c,
+		url:         *u,
+		user:        conf.User,
+		password:    conf.Password,
+		gzip:        conf.Gzip,
+		maxBodySize: conf.MaxBodySize,
+		httpClient:  &http.Client{Timeout: timeout, Transport: transport},
+		transport:   transport,
+	}, nil
+}
+
+// newInfluxV2 creates a new client for the InfluxDB 2.x write api.
+func newInfluxV2(conf *ConfInflux, timeout time.Duration) (*influxV2, error) {
+	addr := conf.URL
+	if addr == "" {
+		addr = conf.Addr
+	}
+
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.New("unsupported protocol scheme \"" + u.Scheme + "\"")
+	}
+
+	token, err := conf.token()
+	if err != nil {
+		return nil, err
+	}
+
+	transport, err := NewHTTPTransport(&conf.TLS, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &influxV2{
+		url:         *u,
+		org:         conf.Org,
+		token:       token,
+		gzip:        conf.Gzip,
+		maxBodySize: conf.MaxBodySize,
+		httpClient:  &http.Client{Timeout: timeout, Transport: transport},
+		transport:   transport,
+	}, nil
+}
+
+// ---------------------------------------------------------------------------------------
+//  public members
+// ---------------------------------------------------------------------------------------
+
+// Write writes the batch with as many requests as required by the
+// maximum body size. If a request fails the batch is incomplete.
+func (c *influxV1) Write(bp client.BatchPoints) error {
+	u := c.url
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/write"
+	params := url.Values{}
+	params.Set("db", bp.Database())
+	params.Set("rp", bp.RetentionPolicy())
+	params.Set("precision", bp.Precision())
+	params.Set("consistency", bp.WriteConsistency())
+	u.RawQuery = params.Encode()
+
+	for _, body := range splitLines(bp.Points(), bp.Precision(), c.maxBodySize) {
+		req, err := newWriteRequest(u.String(), body, c.gzip)
+		if err != nil {
+			return err
+		}
+		if c.user != "" {
+			req.SetBasicAuth(c.user, c.password)
+		}
+
+		resp, err := c.httpClient.Do(req)
+		if err != nil {
+			return err
+		}
+
+		err = checkResponse(resp)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Close releases the resources of the client.
+func (c *influxV1) Close() error {
+	c.transport.CloseIdleConnections()
+	return c.Client.Close()
+}
+
+// Ping checks the availability of the server.
+func (c *influxV2) Ping(timeout time.Duration) (time.Duration, string, error) {
+	now := time.Now()
+	u := c.url
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/ping"
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return 0, "", err
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return 0, "", err
+	}
+
+	return time.Since(now), resp.Header.Get("X-Influxdb-Version"), nil
+}
+
+// Write writes the batch to the bucket named like the database of the batch.
+// A retention policy is appended as "database/retention_policy", which
+// is the bucket naming used by the v1 compatibility api. The batch is
+// written with as many requests as required by the maximum body size.
+func (c *influxV2) Write(bp client.BatchPoints) error {
+	bucket := bp.Database()
+	if bp.RetentionPolicy() != "" {
+		bucket += "/" + bp.RetentionPolicy()
+	}
+
+	u := c.url
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/api/v2/write"
+	params := url.Values{}
+	params.Set("org", c.org)
+	params.Set("bucket", bucket)
+	params.Set("precision", bp.Precision())
+	u.RawQuery = params.Encode()
+
+	precision := lineProtocolPrecision(bp.Precision())
+	for _, body := range splitLines(bp.Points(), precision, c.maxBodySize) {
+		req, err := newWriteRequest(u.String(), body, c.gzip)
+		if err != nil {
+			return err
+		}
+
+		_, err = c.do(req)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Query is not supported by the v2 write client.
+func (c *influxV2) Query(q client.Query) (*client.Response, error) {
+	return nil, errors.New("querying is not supported by the influxdb v2 client")
+}
+
+// Close releases the resources of the client.
+func (c *influxV2) Close() error {
+	c.transport.CloseIdleConnections()
+	return nil
+}
+
+// ---------------------------------------------------------------------------------------
+//  private members
+// ---------------------------------------------------------------------------------------
+
+// do executes the request and checks the status code of the response.
+func (c *influxV2) do(req *http.Request) (*http.Response, error) {
+	req.Header.Set("User-Agent", UserAgent)
+	if c.token != "" {
+		req.Header.Set("Authorization", "Token "+c.token)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	err = checkResponse(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,284 @@
+package main
+
+// sysflux
+// Copyright (C) 2018 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// --------------------------------------------------------------------------------------
+//  constants
+// --------------------------------------------------------------------------------------
+
+const (
+	DefaultLineBufferSize = 100000
+
+	lineWriterMinBackoff = 500 * time.Millisecond
+	lineWriterMaxBackoff = 30 * time.Second
+)
+
+// ---------------------------------------------------------------------------------------
+//  types
+// ---------------------------------------------------------------------------------------
+
+// LineWriter sends lines over a tcp connection. It reconnects automatically
+// and buffers the lines while disconnected. If the buffer is full the
+// oldest lines are discarded.
+type LineWriter struct {
+	Addr       string
+	BufferSize int
+	Timeout    time.Duration
+
+	// internal variables
+	pending [][]byte
+	dropped uint64
+	conn    net.Conn
+	closed  bool
+	signal  chan struct{}
+	done    chan struct{}
+	stopped chan struct{}
+	sync.Mutex
+}
+
+// ---------------------------------------------------------------------------------------
+//  public functions
+// ---------------------------------------------------------------------------------------
+
+// NewLineWriter creates a new line writer and starts its sender.
+func NewLineWriter(addr string, bufferSize int, timeout time.Duration) *LineWriter {
+	if bufferSize <= 0 {
+		bufferSize = DefaultLineBufferSize
+	}
+
+	w := LineWriter{
+		Addr:       addr,
+		BufferSize: bufferSize,
+		Timeout:    timeout,
+		signal:     make(chan struct{}, 1),
+		done:       make(chan struct{}),
+		stopped:    make(chan struct{}),
+	}
+	go w.run()
+
+	return &w
+}
+
+// ---------------------------------------------------------------------------------------
+//  public members
+// ---------------------------------------------------------------------------------------
+
+// Write enqueues the lines for sending. Every line must
+// include its trailing newline.
+func (w *LineWriter) Write(lines [][]byte) {
+	w.Lock()
+	w.pending = append(w.pending, lines...)
+	if overflow := len(w.pending) - w.BufferSize; overflow > 0 {
+		w.pending = w.pending[overflow:]
+		w.dropped += uint64(overflow)
+		logrus.Warnf("%s: send buffer full, discarded %d lines (total: %d)",
+			w.Addr, overflow, w.dropped)
+	}
+	w.Unlock()
+
+	select {
+	case w.signal <- struct{}{}:
+	default:
+	}
+}
+
+// Drain stops the sender and sends the pending lines until the deadline,
+// failed sends are retried meanwhile. The number of lines which have not
+// been sent is returned, they are discarded.
+func (w *LineWriter) Drain(deadline time.Time) int {
+	w.stop()
+
+	backoff := lineWriterMinBackoff
+	for time.Now().Before(deadline) {
+		err := w.flush()
+		if err == nil {
+			break
+		}
+
+		wait := time.Until(deadline)
+		if backoff < wait {
+			wait = backoff
+		}
+		logrus.Warnf("%s: send failed, retrying in %s: %s", w.Addr, wait, err.Error())
+		time.Sleep(wait)
+		backoff *= 2
+	}
+
+	w.Lock()
+	defer w.Unlock()
+
+	discarded := len(w.pending)
+	w.pending = nil
+	if discarded > 0 {
+		w.dropped += uint64(discarded)
+		logrus.Warnf("%s: shutdown timeout expired, discarded %d lines (total: %d)",
+			w.Addr, discarded, w.dropped)
+	}
+
+	return discarded
+}
+
+// Close stops the sender and closes the connection.
+// Lines which have not been sent yet are discarded.
+func (w *LineWriter) Close() error {
+	w.stop()
+
+	w.Lock()
+	defer w.Unlock()
+	if w.conn != nil {
+		return w.conn.Close()
+	}
+
+	return nil
+}
+
+// ---------------------------------------------------------------------------------------
+//  private members
+// ---------------------------------------------------------------------------------------
+
+// run sends all pending lines whenever new lines are written.
+// Failed connections are retried with an exponential backoff.
+func (w *LineWriter) run() {
+	defer close(w.stopped)
+	backoff := lineWriterMinBackoff
+
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-w.signal:
+		}
+
+		for {
+			err := w.flush()
+			if err == nil {
+				backoff = lineWriterMinBackoff
+				break
+			}
+
+			logrus.Warnf("%s: send failed, retrying in %s: %s", w.Addr, backoff, err.Error())
+			select {
+			case <-w.done:
+				return
+			case <-time.After(backoff):
+			}
+
+			backoff *= 2
+			if backoff > lineWriterMaxBackoff {
+				backoff = lineWriterMaxBackoff
+			}
+		}
+	}
+}
+
+// stop stops the sender and waits for it to exit.
+func (w *LineWriter) stop() {
+	w.Lock()
+	closed := w.closed
+	w.closed = true
+	w.Unlock()
+
+	if !closed {
+		close(w.done)
+	}
+	<-w.stopped
+}
+
+// flush sends all pending lines. On failure the lines which have not
+// been sent completely are requeued and the connection is closed.
+func (w *LineWriter) flush() error {
+	w.Lock()
+	lines := w.pending
+	w.pending = nil
+	conn := w.conn
+	w.Unlock()
+
+	if len(lines) < 1 {
+		return nil
+	}
+
+	var err error
+	if conn == nil {
+		conn, err = net.DialTimeout("tcp", w.Addr, w.Timeout)
+		if err != nil {
+			w.requeue(lines, nil)
+			return err
+		}
+		logrus.Infof("%s: connected", w.Addr)
+	}
+
+	buffers := net.Buffers(append([][]byte(nil), lines...))
+	if w.Timeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(w.Timeout))
+	}
+	written, err := buffers.WriteTo(conn)
+	if err != nil {
+		conn.Close()
+		w.requeue(unwritten(lines, written), nil)
+		return err
+	}
+
+	w.Lock()
+	w.conn = conn
+	w.Unlock()
+
+	return nil
+}
+
+// requeue puts the lines in front of the pending lines
+// and replaces the connection.
+func (w *LineWriter) requeue(lines [][]byte, conn net.Conn) {
+	w.Lock()
+	defer w.Unlock()
+
+	w.conn = conn
+	w.pending = append(lines, w.pending...)
+	if overflow := len(w.pending) - w.BufferSize; overflow > 0 {
+		w.pending = w.pending[overflow:]
+		w.dropped += uint64(overflow)
+	}
+}
+
+// ---------------------------------------------------------------------------------------
+//  private functions
+// ---------------------------------------------------------------------------------------
+
+// unwritten returns the lines starting at the first byte which has not
+// been written. A partially written line is continued at its remainder.
+func unwritten(lines [][]byte, written int64) [][]byte {
+	for len(lines) > 0 && written >= int64(len(lines[0])) {
+		written -= int64(len(lines[0]))
+		lines = lines[1:]
+	}
+	if len(lines) > 0 && written > 0 {
+		lines = append([][]byte{lines[0][written:]}, lines[1:]...)
+	}
+
+	return lines
+}
@@ -0,0 +1,59 @@
+package main
+
+// sysflux
+// Copyright (C) 2018 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"reflect"
+	"testing"
+)
+
+// ---------------------------------------------------------------------------------------
+//  tests
+// ---------------------------------------------------------------------------------------
+
+func TestUnwritten(t *testing.T) {
+	lines := [][]byte{[]byte("a.b 1 1\n"), []byte("c.d 2 1\n"), []byte("e.f 3 1\n")}
+
+	tests := []struct {
+		written  int64
+		expected []string
+	}{
+		{0, []string{"a.b 1 1\n", "c.d 2 1\n", "e.f 3 1\n"}},
+		{8, []string{"c.d 2 1\n", "e.f 3 1\n"}},
+		{11, []string{" 2 1\n", "e.f 3 1\n"}},
+		{24, []string{}},
+	}
+
+	for _, test := range tests {
+		result := make([]string, 0)
+		for _, line := range unwritten(lines, test.written) {
+			result = append(result, string(line))
+		}
+		if !reflect.DeepEqual(result, test.expected) {
+			t.Errorf("written %d: got %q, expected %q", test.written, result, test.expected)
+		}
+	}
+
+	// the lines of the caller are not modified
+	if string(lines[1]) != "c.d 2 1\n" {
+		t.Errorf("lines modified: %q", lines)
+	}
+}
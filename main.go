@@ -21,13 +21,13 @@ package main
 // ---------------------------------------------------------------------------------------
 
 import (
+	"errors"
 	"flag"
 	"os"
 	"syscall"
 	"time"
 
 	"github.com/faryon93/util"
-	"github.com/influxdata/influxdb/client/v2"
 	"github.com/sirupsen/logrus"
 )
 
@@ -36,16 +36,27 @@ import (
 // ---------------------------------------------------------------------------------------
 
 func main() {
-	var colors bool
+	var colors, dryRun bool
 	var timeout time.Duration
+	var dryRunFormat, stats string
 	flag.BoolVar(&colors, "colors", false, "force color logging")
 	flag.DurationVar(&timeout, "timeout", 800*time.Millisecond, "influxdb write timeout")
+	flag.BoolVar(&dryRun, "dry-run", false, "print points to stdout instead of writing them")
+	flag.StringVar(&dryRunFormat, "dry-run-format", FormatLineProtocol, "format of printed points: line or json")
+	flag.StringVar(&stats, "stats", "", "listen address of the statistics endpoint")
 	flag.Parse()
 
-	// setup logger
+	// setup logger, printed points must not be mixed with log messages
 	formater := logrus.TextFormatter{ForceColors: colors}
 	logrus.SetFormatter(&formater)
 	logrus.SetOutput(os.Stdout)
+	if dryRun {
+		logrus.SetOutput(os.Stderr)
+	}
+
+	if dryRunFormat != FormatLineProtocol && dryRunFormat != FormatJSON {
+		panic(errors.New("invalid dry-run format \"" + dryRunFormat + "\""))
+	}
 
 	logrus.Infoln("starting", GetAppVersion())
 
@@ -54,27 +65,77 @@ func main() {
 		panic(err)
 	}
 
-	// construct the influxdb configuration
-	influxConfig := client.HTTPConfig{
-		Addr:     conf.Influx.Addr,
-		Username: conf.Influx.User,
-		Password: conf.Influx.Password,
-		Timeout:  timeout,
+	if stats != "" {
+		ServeStats(stats)
 	}
 
+	// the sink of an output is shared by all recorders writing to it,
+	// every output has its own buffer so outputs do not affect each other
+	sinks := make(map[string]Sink)
+	stdout := NewStdoutSink(dryRunFormat)
 	recorders := make([]*Recorder, 0)
+	checks := make([]*HealthCheck, 0)
 	for i, syslog := range conf.Syslog {
-		influx, err := client.NewHTTPClient(influxConfig)
-		if err != nil {
-			logrus.Errorf("syslog(%d): failed to create influx client: %s", i, err.Error())
+		recSinks := make(map[string]Sink)
+		failed := false
+		for _, output := range syslog.Outputs {
+			if dryRun || syslog.DryRun {
+				recSinks[output.Output] = stdout
+				continue
+			}
+
+			sink, ok := sinks[output.Output]
+			if !ok {
+				outputConf := conf.Outputs[output.Output]
+				s, err := NewSink(output.Output, outputConf, timeout)
+				if err != nil {
+					logrus.Errorf("syslog(%d): failed to create %s: %s",
+						i, OutputName(output.Output), err.Error())
+					failed = true
+					break
+				}
+
+				// the startup check runs before the buffer replays its spool
+				var health *HealthCheck
+				if pinger, ok := s.(Pinger); ok {
+					health = NewHealthCheck(OutputName(output.Output), pinger,
+						outputConf.HealthInterval, timeout)
+					err = health.Startup(outputConf.Startup)
+					if err != nil {
+						panic(errors.New(OutputName(output.Output) + ": " + err.Error()))
+					}
+				}
+
+				sink, err = NewBufferSink(OutputName(output.Output), s, outputConf.ConfBuffer)
+				if err != nil {
+					logrus.Errorf("syslog(%d): failed to create buffer of %s: %s",
+						i, OutputName(output.Output), err.Error())
+					if health != nil {
+						health.Stop()
+					}
+					s.Close()
+					failed = true
+					break
+				}
+				sinks[output.Output] = sink
+				if health != nil {
+					checks = append(checks, health)
+				}
+			}
+			recSinks[output.Output] = sink
+		}
+		if failed {
 			continue
 		}
+		if dryRun || syslog.DryRun {
+			logrus.Infof("syslog(%d): dry run, printing points to stdout", i)
+		}
 
 		logrus.Infof("starting syslog(%d) listener (sz: %d, timeout: %s, listen: %s)",
 			i, syslog.BatchSize, syslog.BatchTimeout, syslog.Listen)
 
 		// setup the recorder
-		rec := Recorder{Influx: influx, Conf: *syslog}
+		rec := Recorder{Sinks: recSinks, Conf: *syslog}
 		err = rec.Setup()
 		if err != nil {
 			logrus.Errorf("syslog(%d): failed to setup recorders: %s", i, err.Error())
@@ -89,8 +150,39 @@ func main() {
 	util.WaitSignal(os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
 	logrus.Infoln("received SIGINT / SIGTERM going to shutdown")
 
+	// the timeout includes stopping the recorders, which write their
+	// pending batches and might wait for space in a full buffer
+	deadline := time.Now().Add(conf.ShutdownTimeout)
+	outputs := make([]Sink, 0, len(sinks))
+	for _, sink := range sinks {
+		outputs = append(outputs, sink)
+	}
+	ExpireSinks(outputs, deadline)
+	logrus.Infof("writing pending points (timeout: %s)", conf.ShutdownTimeout)
+
 	for i, rec := range recorders {
 		rec.Stop()
 		logrus.Infof("stopped syslog(%d) recorder", i)
 	}
+
+	for _, health := range checks {
+		health.Stop()
+	}
+
+	// the buffers keep retrying failed writes until the timeout expires
+	logrus.Infoln("writing buffered points")
+	discarded := DrainSinks(outputs, deadline)
+
+	for name, sink := range sinks {
+		err := sink.Close()
+		if err != nil {
+			logrus.Errorf("failed to close %s: %s", OutputName(name), err.Error())
+		}
+	}
+
+	if discarded > 0 {
+		logrus.Warnf("discarded %d points on shutdown", discarded)
+	} else {
+		logrus.Infoln("no points have been discarded")
+	}
 }
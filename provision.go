@@ -0,0 +1,210 @@
+package main
+
+// sysflux
+// Copyright (C) 2018 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/sirupsen/logrus"
+)
+
+// ---------------------------------------------------------------------------------------
+//  types
+// ---------------------------------------------------------------------------------------
+
+// provisioner is an influxdb client which creates missing databases
+// and their retention policies before they are written to.
+type provisioner struct {
+	client.Client
+	Addr     string
+	Policies map[string]*ConfRetentionPolicy
+
+	// internal variables
+	provisioned map[string]bool
+	sync.Mutex
+}
+
+// ---------------------------------------------------------------------------------------
+//  public members
+// ---------------------------------------------------------------------------------------
+
+// Write creates the database of the batch if it has not been
+// provisioned yet and writes the batch afterwards.
+func (p *provisioner) Write(bp client.BatchPoints) error {
+	err := p.provision(bp.Database())
+	if err != nil {
+		return err
+	}
+
+	return p.Client.Write(bp)
+}
+
+// ---------------------------------------------------------------------------------------
+//  private members
+// ---------------------------------------------------------------------------------------
+
+// provision creates the database and its retention policies if they do not exist.
+func (p *provisioner) provision(database string) error {
+	p.Lock()
+	defer p.Unlock()
+
+	if database == "" || p.provisioned[database] {
+		return nil
+	}
+
+	databases, err := p.names("SHOW DATABASES", "")
+	if err != nil {
+		return err
+	}
+	if !databases[database] {
+		err = p.exec("CREATE DATABASE "+quoteIdent(database), "")
+		if err != nil {
+			return err
+		}
+		logrus.Infof("%s: created database %s", p.Addr, database)
+	}
+
+	policies, err := p.names("SHOW RETENTION POLICIES ON "+quoteIdent(database), database)
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(p.Policies))
+	for name := range p.Policies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if policies[name] {
+			continue
+		}
+
+		err = p.exec(createRetentionPolicy(name, database, p.Policies[name]), database)
+		if err != nil {
+			return err
+		}
+		logrus.Infof("%s: created retention policy %s on database %s", p.Addr, name, database)
+	}
+
+	p.provisioned[database] = true
+	return nil
+}
+
+// names executes the query and returns the values of the
+// name column, as returned by the show statements.
+func (p *provisioner) names(command, database string) (map[string]bool, error) {
+	resp, err := p.Query(client.NewQuery(command, database, ""))
+	if err == nil {
+		err = resp.Error()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]bool)
+	for _, result := range resp.Results {
+		for _, row := range result.Series {
+			for _, values := range row.Values {
+				if len(values) < 1 {
+					continue
+				}
+				if name, ok := values[0].(string); ok {
+					names[name] = true
+				}
+			}
+		}
+	}
+
+	return names, nil
+}
+
+// exec executes a statement which does not return any values.
+func (p *provisioner) exec(command, database string) error {
+	resp, err := p.Query(client.NewQuery(command, database, ""))
+	if err != nil {
+		return err
+	}
+
+	return resp.Error()
+}
+
+// ---------------------------------------------------------------------------------------
+//  private functions
+// ---------------------------------------------------------------------------------------
+
+// newProvisioner creates a provisioning client and
+// provisions the given databases on a best effort basis.
+func newProvisioner(c client.Client, addr string, conf *ConfInflux) *provisioner {
+	p := provisioner{
+		Client:      c,
+		Addr:        addr,
+		Policies:    conf.RetentionPolicies,
+		provisioned: make(map[string]bool),
+	}
+
+	for _, database := range conf.databases {
+		err := p.provision(database)
+		if err != nil {
+			logrus.Warnf("%s: failed to provision database %s, retrying on first write: %s",
+				addr, database, err.Error())
+		}
+	}
+
+	return &p
+}
+
+// createRetentionPolicy returns the statement creating the retention policy.
+func createRetentionPolicy(name, database string, rp *ConfRetentionPolicy) string {
+	stmt := "CREATE RETENTION POLICY " + quoteIdent(name) + " ON " + quoteIdent(database) +
+		" DURATION " + influxDuration(rp.Duration) +
+		" REPLICATION " + strconv.Itoa(rp.Replication)
+	if rp.ShardDuration > 0 {
+		stmt += " SHARD DURATION " + influxDuration(rp.ShardDuration)
+	}
+	if rp.Default {
+		stmt += " DEFAULT"
+	}
+
+	return stmt
+}
+
+// influxDuration formats the duration as influxql duration literal,
+// a duration of 0 is infinite.
+func influxDuration(d time.Duration) string {
+	if d <= 0 {
+		return "INF"
+	}
+	if d%time.Second != 0 {
+		return strconv.FormatInt(int64(d/time.Millisecond), 10) + "ms"
+	}
+
+	return strconv.FormatInt(int64(d/time.Second), 10) + "s"
+}
+
+// quoteIdent quotes the identifier for the use in influxql statements.
+func quoteIdent(name string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(name) + `"`
+}
@@ -22,12 +22,12 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"regexp"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/influxdata/influxdb/client/v2"
 	"github.com/sirupsen/logrus"
 	"gopkg.in/mcuadros/go-syslog.v2"
 	"gopkg.in/mcuadros/go-syslog.v2/format"
@@ -38,8 +38,9 @@ import (
 // --------------------------------------------------------------------------------------
 
 const (
-	PrefixTag   = "tag_"
-	PrefixValue = "val_"
+	PrefixTag         = "tag_"
+	PrefixValue       = "val_"
+	PrefixMeasurement = "meas_"
 )
 
 // ---------------------------------------------------------------------------------------
@@ -47,13 +48,16 @@ const (
 // ---------------------------------------------------------------------------------------
 
 type Recorder struct {
-	Influx client.Client
-	Conf   ConfSyslog
+	Sinks map[string]Sink
+	Conf  ConfSyslog
 
 	// internal variables
-	matcher *regexp.Regexp
-	syslog  *syslog.Server
-	batch   Batch
+	matcher     *regexp.Regexp
+	measurement *Template
+	derived     []Derived
+	correlators []*Correlator
+	syslog      *syslog.Server
+	fanout      *Fanout
 }
 
 type Tags map[string]string
@@ -71,13 +75,40 @@ func (r *Recorder) Setup() error {
 	}
 	r.matcher = matcher
 
-	// construct the initial point batch
-	r.batch = Batch{
-		Timeout:     r.Conf.BatchTimeout,
-		Size:        r.Conf.BatchSize,
-		Influx:      r.Influx,
-		Database:    r.Conf.Database,
-		Measurement: r.Conf.Measurement,
+	// compile the expressions of derived tags and fields
+	err = r.compileDerived()
+	if err != nil {
+		return err
+	}
+
+	// compile the measurement name template
+	err = r.compileMeasurement()
+	if err != nil {
+		return err
+	}
+
+	// construct the routers of all outputs which maintain the point batches
+	r.fanout = &Fanout{}
+	for i, output := range r.Conf.Outputs {
+		router, err := NewRouter(output, r.Sinks[output.Output], r.templateNames())
+		if err != nil {
+			return fmt.Errorf("outputs(%d): %s", i, err.Error())
+		}
+		r.fanout.AddOutput(output.Output, output.Match, router)
+
+		if output.BatchTimeout == 0 {
+			logrus.Warnf("%s: no batch timeout configured: batch writes may be late",
+				OutputName(output.Output))
+		}
+	}
+
+	// setup the start / end event correlations
+	for i, conf := range r.Conf.Correlate {
+		correlator, err := NewCorrelator(*conf, r.fanout)
+		if err != nil {
+			return fmt.Errorf("correlate(%d): %s", i, err.Error())
+		}
+		r.correlators = append(r.correlators, correlator)
 	}
 
 	// configure the syslog server
@@ -96,22 +127,29 @@ func (r *Recorder) Setup() error {
 		return err
 	}
 
-	// start the timeout write of the batch
-	if r.Conf.BatchTimeout == 0 {
-		logrus.Warnln("no batch timeout configured: batch writes may be late")
-	} else {
-		go r.batch.Run()
+	for _, correlator := range r.correlators {
+		go correlator.Run()
 	}
 
 	return nil
 }
 
-// Stop destroys this syslog recorder.
+// Stop destroys this syslog recorder. Messages which have already been
+// received are processed and the pending points of all batches are
+// passed to the sinks.
 func (r *Recorder) Stop() {
 	err := r.syslog.Kill()
 	if err != nil {
 		logrus.Errorln("failed to stop syslog:", err.Error())
+	} else {
+		r.syslog.Wait()
+	}
+
+	for _, correlator := range r.correlators {
+		correlator.Stop()
 	}
+
+	r.fanout.Close()
 }
 
 // Processes all incomming syslog messages and transforms them
@@ -125,6 +163,13 @@ func (r *Recorder) Handle(message format.LogParts, t int64, syslogErr error) {
 		return
 	}
 
+	// start and end events are consumed by the correlations
+	for _, correlator := range r.correlators {
+		if correlator.Handle(timestamp, content) {
+			return
+		}
+	}
+
 	// check if the received log messages matches the
 	// configured regex
 	matches := r.matcher.FindStringSubmatch(content)
@@ -134,14 +179,22 @@ func (r *Recorder) Handle(message format.LogParts, t int64, syslogErr error) {
 	}
 
 	// process the message
-	tags, values, err := r.process(matches)
+	tags, values, err := process(r.matcher, matches)
 	if err != nil {
 		logrus.Warnln("failed to process message:", err.Error())
 		logrus.Infoln(content)
 		return
 	}
+	r.derive(message, tags, values)
 
-	err = r.batch.Add(timestamp, tags, values)
+	vars := r.templateVars(message, matches, tags)
+	measurement := r.measurementName(vars, matches)
+	if measurement == "" {
+		logrus.Warnln("empty measurement name: ignoring message:", content)
+		return
+	}
+
+	err = r.fanout.Add(vars, measurement, timestamp, tags, values)
 	if err != nil {
 		logrus.Errorln("failed to write datapoint:", err.Error())
 		return
@@ -152,15 +205,110 @@ func (r *Recorder) Handle(message format.LogParts, t int64, syslogErr error) {
 //  private members
 // ----------------------------------------------------------------------------------
 
-// process processes a log messages.
-func (r *Recorder) process(matches []string) (Tags, Values, error) {
+// compileMeasurement compiles the configured measurement template.
+func (r *Recorder) compileMeasurement() error {
+	measurement, err := CompileTemplate(r.Conf.Measurement, r.templateNames())
+	if err != nil {
+		return err
+	}
+	r.measurement = measurement
+
+	if measurement.Source == "" && !r.hasMeasurementCapture() {
+		return errors.New("no measurement or measurement capture group configured")
+	}
+
+	return nil
+}
+
+// measurementName returns the sanitized measurement name of a log message.
+// A non-empty measurement capture group takes precedence over the
+// configured measurement template.
+func (r *Recorder) measurementName(vars map[string]string, matches []string) string {
+	for i, name := range r.matcher.SubexpNames() {
+		if strings.HasPrefix(name, PrefixMeasurement) && matches[i] != "" {
+			return SanitizeName(matches[i])
+		}
+	}
+
+	if r.measurement.IsStatic() {
+		return r.measurement.Source
+	}
+
+	return SanitizeName(r.measurement.Execute(vars))
+}
+
+// templateNames returns all names which can be referenced by templates:
+// the capture groups, the syslog header fields and the derived tags.
+func (r *Recorder) templateNames() map[string]bool {
+	known := make(map[string]bool)
+	for _, name := range r.matcher.SubexpNames() {
+		known[name] = true
+	}
+	for _, name := range syslogHeaderFields {
+		known[PrefixSyslog+name] = true
+	}
+	for _, derived := range r.derived {
+		if derived.Tag {
+			known[PrefixTag+derived.Name] = true
+		}
+	}
+
+	return known
+}
+
+// templateVars returns the variables of a log message which
+// are referenced by templates.
+func (r *Recorder) templateVars(message format.LogParts, matches []string, tags Tags) map[string]string {
+	vars := tagVars(tags)
+	for i, name := range r.matcher.SubexpNames() {
+		if name != "" {
+			vars[name] = matches[i]
+		}
+	}
+	for _, name := range syslogHeaderFields {
+		if v, ok := message[name]; ok {
+			vars[PrefixSyslog+name] = toString(v)
+		}
+	}
+
+	return vars
+}
+
+// hasMeasurementCapture returns true if the regex contains
+// at least one measurement capture group.
+func (r *Recorder) hasMeasurementCapture() bool {
+	for _, name := range r.matcher.SubexpNames() {
+		if strings.HasPrefix(name, PrefixMeasurement) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ----------------------------------------------------------------------------------
+//  private functions
+// ----------------------------------------------------------------------------------
+
+// tagVars returns the template variables of the given tags.
+func tagVars(tags Tags) map[string]string {
+	vars := make(map[string]string, len(tags))
+	for k, v := range tags {
+		vars[PrefixTag+k] = v
+	}
+
+	return vars
+}
+
+// process processes the regex matches of a log message.
+func process(matcher *regexp.Regexp, matches []string) (Tags, Values, error) {
 	// maps which are used to construct the new datapoint
 	tags := make(map[string]string)
 	values := make(map[string]interface{})
 
 	// process all regex caputure groups and add to the coresponding
 	// map in oder to insert the data into the datapoint
-	for i, name := range r.matcher.SubexpNames() {
+	for i, name := range matcher.SubexpNames() {
 		if i > 0 && len(name) > 0 {
 			val := matches[i]
 
@@ -177,7 +325,9 @@ func (r *Recorder) process(matches []string) (Tags, Values, error) {
 				}
 
 				values[strings.TrimPrefix(name, PrefixValue)] = float32(value)
-			} else {
+
+				// the measurement name is handled by the recorder
+			} else if !strings.HasPrefix(name, PrefixMeasurement) {
 				return nil, nil, errors.New("unknown capture group naming prefix")
 			}
 		}
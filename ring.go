@@ -0,0 +1,122 @@
+package main
+
+// sysflux
+// Copyright (C) 2018 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ---------------------------------------------------------------------------------------
+//  types
+// ---------------------------------------------------------------------------------------
+
+// HashRing maps keys consistently onto a set of nodes. Every node is placed
+// on the ring multiple times, so keys are evenly distributed and only the
+// keys of a node move when it is added or removed.
+type HashRing struct {
+	hashes []uint32
+	nodes  []int
+}
+
+// ---------------------------------------------------------------------------------------
+//  public functions
+// ---------------------------------------------------------------------------------------
+
+// NewHashRing creates a ring of the named nodes with the given number
+// of virtual nodes each. The position of a node only depends on its name.
+func NewHashRing(names []string, virtualNodes int) *HashRing {
+	type vnode struct {
+		hash uint32
+		node int
+	}
+
+	vnodes := make([]vnode, 0, len(names)*virtualNodes)
+	for node, name := range names {
+		for i := 0; i < virtualNodes; i++ {
+			vnodes = append(vnodes, vnode{hashKey(name + "#" + strconv.Itoa(i)), node})
+		}
+	}
+	sort.Slice(vnodes, func(i, j int) bool {
+		return vnodes[i].hash < vnodes[j].hash
+	})
+
+	r := HashRing{
+		hashes: make([]uint32, len(vnodes)),
+		nodes:  make([]int, len(vnodes)),
+	}
+	for i, v := range vnodes {
+		r.hashes[i] = v.hash
+		r.nodes[i] = v.node
+	}
+
+	return &r
+}
+
+// SeriesKey returns the key identifying the series of a point:
+// the measurement followed by the tags sorted by name.
+func SeriesKey(measurement string, tags map[string]string) string {
+	names := make([]string, 0, len(tags))
+	for name := range tags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString(measurement)
+	for _, name := range names {
+		b.WriteString("," + name + "=" + tags[name])
+	}
+
+	return b.String()
+}
+
+// ---------------------------------------------------------------------------------------
+//  public members
+// ---------------------------------------------------------------------------------------
+
+// Node returns the index of the node the key belongs to,
+// which is the first virtual node following the hash of the key.
+func (r *HashRing) Node(key string) int {
+	hash := hashKey(key)
+	i := sort.Search(len(r.hashes), func(i int) bool {
+		return r.hashes[i] >= hash
+	})
+	if i == len(r.hashes) {
+		i = 0
+	}
+
+	return r.nodes[i]
+}
+
+// ---------------------------------------------------------------------------------------
+//  private functions
+// ---------------------------------------------------------------------------------------
+
+// hashKey hashes the key like ketama does, md5 spreads
+// similar keys like the ones of virtual nodes evenly.
+func hashKey(key string) uint32 {
+	sum := md5.Sum([]byte(key))
+	return binary.LittleEndian.Uint32(sum[:4])
+}
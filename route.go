@@ -0,0 +1,317 @@
+package main
+
+// sysflux
+// Copyright (C) 2018 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/sirupsen/logrus"
+)
+
+// ---------------------------------------------------------------------------------------
+//  constants
+// ---------------------------------------------------------------------------------------
+
+const (
+	// batches of destinations without points for this duration are closed
+	RouteIdleTimeout = 5 * time.Minute
+)
+
+// ---------------------------------------------------------------------------------------
+//  types
+// ---------------------------------------------------------------------------------------
+
+// Router selects the database and retention policy of every point
+// and maintains a separate batch for each destination. The batches of
+// idle destinations are closed, so templated destinations don't pile up.
+type Router struct {
+	Sink             Sink
+	Precision        string
+	WriteConsistency string
+
+	// internal variables
+	routes  []*route
+	batches map[destination]*Batch
+	used    map[destination]time.Time
+	closed  bool
+	done    chan struct{}
+	stopped chan struct{}
+	sync.Mutex
+}
+
+// route is a compiled routing rule.
+type route struct {
+	match           map[string]string
+	database        *Template
+	retentionPolicy *Template
+	size            int
+	timeout         time.Duration
+}
+
+// destination identifies the batch a point is written to. The
+// shard is the node of a sharded output the points belong to.
+type destination struct {
+	database        string
+	retentionPolicy string
+	shard           int
+}
+
+// ---------------------------------------------------------------------------------------
+//  public functions
+// ---------------------------------------------------------------------------------------
+
+// NewRouter compiles the routing rules of the given recorder output.
+// The templates of the rules may reference all names contained in known.
+// Points not matching any rule are written to the default database.
+func NewRouter(conf *ConfSyslogOutput, sink Sink, known map[string]bool) (*Router, error) {
+	router := Router{
+		Sink:             sink,
+		Precision:        conf.Precision,
+		WriteConsistency: conf.WriteConsistency,
+		routes:           make([]*route, 0, len(conf.Routes)+1),
+		batches:          make(map[destination]*Batch),
+		used:             make(map[destination]time.Time),
+		done:             make(chan struct{}),
+		stopped:          make(chan struct{}),
+	}
+
+	// the configured routes must not be modified
+	routes := make([]*ConfRoute, 0, len(conf.Routes)+1)
+	routes = append(append(routes, conf.Routes...), &ConfRoute{})
+
+	for i, routeConf := range routes {
+		c := *routeConf
+
+		// routes without destination use the one of the output
+		if c.Database == "" {
+			c.Database = conf.Database
+		}
+		if c.RetentionPolicy == "" {
+			c.RetentionPolicy = conf.RetentionPolicy
+		}
+
+		database, err := CompileTemplate(c.Database, known)
+		if err != nil {
+			return nil, fmt.Errorf("route(%d): %s", i, err.Error())
+		}
+
+		retentionPolicy, err := CompileTemplate(c.RetentionPolicy, known)
+		if err != nil {
+			return nil, fmt.Errorf("route(%d): %s", i, err.Error())
+		}
+
+		r := route{
+			match:           c.Match,
+			database:        database,
+			retentionPolicy: retentionPolicy,
+			size:            c.BatchSize,
+			timeout:         c.BatchTimeout,
+		}
+
+		// every route inherits the batching of the output
+		if r.size == 0 {
+			r.size = conf.BatchSize
+		}
+		if r.timeout == 0 {
+			r.timeout = conf.BatchTimeout
+		}
+
+		router.routes = append(router.routes, &r)
+	}
+	go router.evict()
+
+	return &router, nil
+}
+
+// ---------------------------------------------------------------------------------------
+//  public members
+// ---------------------------------------------------------------------------------------
+
+// Add routes a point to the batch of its destination. The variables are used
+// to match the routing rules and to execute the destination templates. If the
+// destination of the matching route lacks a variable, the default route is
+// used. Points without any destination are dropped and counted.
+func (r *Router) Add(vars map[string]string, measurement string, timestamp time.Time, tags Tags, values Values) error {
+	route := r.lookup(vars)
+	dest, ok := route.destination(vars)
+
+	if defaultRoute := r.routes[len(r.routes)-1]; !ok && route != defaultRoute {
+		route = defaultRoute
+		dest, ok = route.destination(vars)
+	}
+	if !ok {
+		unroutedPoints.Add(1)
+		return fmt.Errorf("no database for point of measurement %s", measurement)
+	}
+
+	// every node of a sharded output gets batches of its own size
+	dest.shard = -1
+	if sharder, ok := r.Sink.(Sharder); ok {
+		dest.shard = sharder.Shard(measurement, tags)
+	}
+
+	for {
+		batch := r.batch(dest, route)
+		if batch == nil {
+			return ErrBatchClosed
+		}
+
+		// the batch might have been evicted in the meantime
+		err := batch.Add(measurement, timestamp, tags, values)
+		if err != ErrBatchClosed {
+			return err
+		}
+	}
+}
+
+// Close writes the pending points of all batches.
+func (r *Router) Close() {
+	r.Lock()
+	if !r.closed {
+		r.closed = true
+		close(r.done)
+	}
+	r.Unlock()
+
+	// batches being evicted are closed before
+	<-r.stopped
+
+	r.Lock()
+	defer r.Unlock()
+
+	for _, batch := range r.batches {
+		batch.Close()
+	}
+}
+
+// ---------------------------------------------------------------------------------------
+//  private members
+// ---------------------------------------------------------------------------------------
+
+// lookup returns the first route matching the given variables.
+// The last route is the default route which always matches.
+func (r *Router) lookup(vars map[string]string) *route {
+	for _, route := range r.routes {
+		matches := true
+		for k, v := range route.match {
+			if vars[k] != v {
+				matches = false
+				break
+			}
+		}
+
+		if matches {
+			return route
+		}
+	}
+
+	return r.routes[len(r.routes)-1]
+}
+
+// destination executes the destination templates of the route.
+// False is returned if a template lacks a variable.
+func (r *route) destination(vars map[string]string) (destination, bool) {
+	database, ok := r.database.Resolve(vars)
+	if !ok {
+		return destination{}, false
+	}
+
+	retentionPolicy, ok := r.retentionPolicy.Resolve(vars)
+	if !ok {
+		return destination{}, false
+	}
+
+	return destination{database: database, retentionPolicy: retentionPolicy}, true
+}
+
+// batch returns the batch of the given destination. Missing batches
+// are created with the settings of the route. Nil is returned if the
+// router is closed.
+func (r *Router) batch(dest destination, route *route) *Batch {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.closed {
+		return nil
+	}
+	r.used[dest] = time.Now()
+
+	batch, ok := r.batches[dest]
+	if ok {
+		return batch
+	}
+
+	batch = NewBatch(r.Sink, route.size, route.timeout, client.BatchPointsConfig{
+		Database:         dest.database,
+		RetentionPolicy:  dest.retentionPolicy,
+		Precision:        r.Precision,
+		WriteConsistency: r.WriteConsistency,
+	})
+	r.batches[dest] = batch
+
+	logrus.Infof("routing points to database %s (rp: %s, sz: %d, timeout: %s)",
+		dest.database, dest.retentionPolicy, batch.Size, batch.Timeout)
+
+	return batch
+}
+
+// evict periodically closes the batches of idle destinations.
+func (r *Router) evict() {
+	defer close(r.stopped)
+
+	ticker := time.NewTicker(RouteIdleTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.done:
+			return
+
+		case now := <-ticker.C:
+			for dest, batch := range r.idle(now) {
+				batch.Close()
+				logrus.Debugf("closed idle batch of database %s (rp: %s)",
+					dest.database, dest.retentionPolicy)
+			}
+		}
+	}
+}
+
+// idle removes and returns the batches without points
+// since the idle timeout.
+func (r *Router) idle(now time.Time) map[destination]*Batch {
+	r.Lock()
+	defer r.Unlock()
+
+	idle := make(map[destination]*Batch)
+	for dest, batch := range r.batches {
+		if now.Sub(r.used[dest]) >= RouteIdleTimeout {
+			idle[dest] = batch
+			delete(r.batches, dest)
+			delete(r.used, dest)
+		}
+	}
+
+	return idle
+}
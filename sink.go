@@ -0,0 +1,146 @@
+package main
+
+// sysflux
+// Copyright (C) 2018 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+// ---------------------------------------------------------------------------------------
+//  types
+// ---------------------------------------------------------------------------------------
+
+// Sink is the destination batches of points are written to.
+// Every influxdb client.Client is a sink.
+type Sink interface {
+	// Write writes all points of the batch.
+	Write(bp client.BatchPoints) error
+
+	// Close releases all resources of the sink.
+	Close() error
+}
+
+// Drainer is implemented by sinks which buffer batches.
+type Drainer interface {
+	// Drain writes the buffered batches until the deadline,
+	// closes the sink for writing and returns the number of
+	// discarded points.
+	Drain(deadline time.Time) int
+}
+
+// Blocker is implemented by sinks which can be configured to
+// block writes until there is space.
+type Blocker interface {
+	// Blocking returns true if writes wait for space.
+	Blocking() bool
+}
+
+// Sharder is implemented by sinks which distribute the series on nodes.
+// Points of different nodes are batched separately.
+type Sharder interface {
+	// Shard returns the node of the series or -1 if the
+	// series are not distributed.
+	Shard(measurement string, tags map[string]string) int
+}
+
+// Expirer is implemented by sinks whose writes may block.
+type Expirer interface {
+	// Expire makes blocked writes discard their points once the
+	// deadline has passed. The points are counted by Drain.
+	Expire(deadline time.Time)
+}
+
+// PermanentError is returned by sinks for writes
+// which will never succeed and must not be retried.
+type PermanentError struct {
+	error
+}
+
+// ---------------------------------------------------------------------------------------
+//  public functions
+// ---------------------------------------------------------------------------------------
+
+// NewSink creates the sink of the given output configuration.
+func NewSink(name string, conf *ConfOutput, timeout time.Duration) (Sink, error) {
+	switch conf.Type {
+	case OutputInflux:
+		if len(conf.Addrs) > 0 {
+			return NewClusterSink(name, conf, timeout)
+		}
+		return NewInfluxClient(&conf.ConfInflux, timeout)
+
+	case OutputPrometheus:
+		return NewPrometheusSink(&conf.ConfPrometheus)
+
+	case OutputRemoteWrite:
+		return NewRemoteWriteSink(conf, timeout)
+
+	case OutputGraphite:
+		return NewGraphiteSink(conf, timeout)
+
+	case OutputOpenTSDB:
+		return NewOpenTSDBSink(conf, timeout)
+
+	case OutputStatsD:
+		return NewStatsDSink(conf, timeout)
+
+	case OutputFile:
+		return NewFileSink(&conf.ConfFile)
+	}
+
+	return nil, errors.New("unsupported output type \"" + conf.Type + "\"")
+}
+
+// ExpireSinks sets the deadline of all sinks with blocking writes.
+func ExpireSinks(sinks []Sink, deadline time.Time) {
+	for _, sink := range sinks {
+		if expirer, ok := sink.(Expirer); ok {
+			expirer.Expire(deadline)
+		}
+	}
+}
+
+// DrainSinks drains all sinks buffering batches in parallel and
+// returns the total number of discarded points.
+func DrainSinks(sinks []Sink, deadline time.Time) int {
+	var wg sync.WaitGroup
+	var discarded int64
+	for _, sink := range sinks {
+		drainer, ok := sink.(Drainer)
+		if !ok {
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			atomic.AddInt64(&discarded, int64(drainer.Drain(deadline)))
+		}()
+	}
+	wg.Wait()
+
+	return int(discarded)
+}
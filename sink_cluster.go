@@ -0,0 +1,373 @@
+package main
+
+// sysflux
+// Copyright (C) 2018 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"errors"
+	"expvar"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/sirupsen/logrus"
+)
+
+// --------------------------------------------------------------------------------------
+//  constants
+// --------------------------------------------------------------------------------------
+
+const (
+	ModeFailover  = "failover"
+	ModeReplicate = "replicate"
+	ModeShard     = "shard"
+)
+
+// ---------------------------------------------------------------------------------------
+//  types
+// ---------------------------------------------------------------------------------------
+
+// ClusterSink writes to multiple nodes of an influxdb. In failover mode
+// batches are written to the first healthy node, in replicate mode every
+// node receives all batches through its own buffer. In shard mode the
+// series are distributed on a hash ring and every node receives the
+// points of its series through its own buffer. The health of the nodes
+// is checked by the health check of the output, so failed nodes are
+// used again as soon as they are available.
+type ClusterSink struct {
+	Name string
+	Mode string
+
+	// internal variables
+	nodes   []*influxNode
+	buffers []*BufferSink
+	ring    *HashRing
+}
+
+// influxNode is a single node of a cluster which keeps track of its health.
+type influxNode struct {
+	Name string
+	Addr string
+
+	// internal variables
+	client  client.Client
+	healthy bool
+	metric  *expvar.Int
+	sync.Mutex
+}
+
+// ---------------------------------------------------------------------------------------
+//  public functions
+// ---------------------------------------------------------------------------------------
+
+// NewClusterSink creates a sink for all addresses of the influxdb output.
+func NewClusterSink(name string, conf *ConfOutput, timeout time.Duration) (*ClusterSink, error) {
+	s := ClusterSink{
+		Name: OutputName(name),
+		Mode: conf.Mode,
+	}
+
+	for i, addr := range conf.Addrs {
+		node, err := newInfluxNode(s.Name, addr, conf.ConfInflux, timeout)
+		if err != nil {
+			s.close()
+			return nil, errors.New(addr + ": " + err.Error())
+		}
+		s.nodes = append(s.nodes, node)
+
+		if s.Mode == ModeFailover {
+			continue
+		}
+
+		// every node spools to its own directory
+		bufConf := conf.ConfBuffer
+		if bufConf.SpoolDir != "" {
+			bufConf.SpoolDir = filepath.Join(bufConf.SpoolDir, strconv.Itoa(i))
+		}
+		buffer, err := NewBufferSink(s.Name+" node "+addr, node, bufConf)
+		if err != nil {
+			node.Close()
+			s.nodes = s.nodes[:len(s.nodes)-1]
+			s.close()
+			return nil, errors.New(addr + ": " + err.Error())
+		}
+		s.buffers = append(s.buffers, buffer)
+	}
+
+	if s.Mode == ModeShard {
+		s.ring = NewHashRing(conf.Addrs, conf.VirtualNodes)
+	}
+
+	return &s, nil
+}
+
+// ---------------------------------------------------------------------------------------
+//  public members
+// ---------------------------------------------------------------------------------------
+
+// Write writes the batch to the nodes according to the mode of the cluster.
+func (s *ClusterSink) Write(bp client.BatchPoints) error {
+	switch s.Mode {
+	case ModeReplicate:
+		return s.replicate(bp)
+	case ModeShard:
+		return s.shard(bp)
+	}
+
+	return s.failover(bp)
+}
+
+// Ping checks the availability of all nodes. A failover cluster is
+// available if any node is, the other modes require all nodes.
+func (s *ClusterSink) Ping(timeout time.Duration) (time.Duration, string, error) {
+	start := time.Now()
+	available := 0
+	var version string
+	var failed error
+	for _, n := range s.nodes {
+		_, v, err := n.client.Ping(timeout)
+		n.setHealthy(err)
+		if err != nil {
+			if failed == nil {
+				failed = errors.New(n.Addr + ": " + err.Error())
+			}
+			continue
+		}
+
+		available++
+		version = v
+	}
+
+	if failed != nil && (s.Mode != ModeFailover || available < 1) {
+		return 0, "", failed
+	}
+
+	return time.Since(start), version, nil
+}
+
+// Shard returns the node of the series in shard mode and -1 otherwise.
+func (s *ClusterSink) Shard(measurement string, tags map[string]string) int {
+	if s.Mode != ModeShard {
+		return -1
+	}
+
+	return s.ring.Node(SeriesKey(measurement, tags))
+}
+
+// Expire sets the deadline of the node buffers in replicate and shard mode.
+func (s *ClusterSink) Expire(deadline time.Time) {
+	ExpireSinks(s.nodeBuffers(), deadline)
+}
+
+// Drain drains the buffers of the nodes in replicate and shard mode.
+func (s *ClusterSink) Drain(deadline time.Time) int {
+	return DrainSinks(s.nodeBuffers(), deadline)
+}
+
+// Close closes all nodes. In replicate and shard mode pending
+// batches of the nodes are handled like the ones of any other buffer.
+func (s *ClusterSink) Close() error {
+	return s.close()
+}
+
+// Write writes the batch to the node and updates its health.
+// Rejected points do not affect the health of the node.
+func (n *influxNode) Write(bp client.BatchPoints) error {
+	err := n.client.Write(bp)
+	if _, permanent := err.(PermanentError); !permanent {
+		n.setHealthy(err)
+	}
+
+	return err
+}
+
+// Close closes the client of the node.
+func (n *influxNode) Close() error {
+	return n.client.Close()
+}
+
+// ---------------------------------------------------------------------------------------
+//  private members
+// ---------------------------------------------------------------------------------------
+
+// nodeBuffers returns the buffers of the nodes as sinks.
+func (s *ClusterSink) nodeBuffers() []Sink {
+	sinks := make([]Sink, len(s.buffers))
+	for i, b := range s.buffers {
+		sinks[i] = b
+	}
+
+	return sinks
+}
+
+// failover writes the batch to the first healthy node. If the write fails
+// the next healthy node is used. When no node is healthy all nodes are
+// tried, because the health checks might not have noticed a recovery yet.
+func (s *ClusterSink) failover(bp client.BatchPoints) error {
+	nodes := make([]*influxNode, 0, len(s.nodes))
+	for _, n := range s.nodes {
+		if n.isHealthy() {
+			nodes = append(nodes, n)
+		}
+	}
+	if len(nodes) < 1 {
+		nodes = s.nodes
+	}
+
+	var err error
+	for _, n := range nodes {
+		err = n.Write(bp)
+		if _, permanent := err.(PermanentError); err == nil || permanent {
+			return err
+		}
+	}
+
+	return err
+}
+
+// replicate enqueues the batch in the buffers of all nodes.
+func (s *ClusterSink) replicate(bp client.BatchPoints) error {
+	var result error
+	for _, b := range s.buffers {
+		err := b.Write(bp)
+		if err != nil && result == nil {
+			result = err
+		}
+	}
+
+	return result
+}
+
+// shard splits the batch by the nodes of its series and enqueues the
+// parts in the buffers of the nodes. Batches of a router contain the
+// points of a single node, because the router batches every shard
+// separately.
+func (s *ClusterSink) shard(bp client.BatchPoints) error {
+	shards := make([]client.BatchPoints, len(s.nodes))
+	for _, pt := range bp.Points() {
+		i := s.ring.Node(SeriesKey(pt.Name(), pt.Tags()))
+		if shards[i] == nil {
+			shards[i], _ = client.NewBatchPoints(client.BatchPointsConfig{
+				Database:         bp.Database(),
+				RetentionPolicy:  bp.RetentionPolicy(),
+				Precision:        bp.Precision(),
+				WriteConsistency: bp.WriteConsistency(),
+			})
+		}
+		shards[i].AddPoint(pt)
+	}
+
+	var result error
+	for i, shard := range shards {
+		if shard == nil {
+			continue
+		}
+
+		err := s.buffers[i].Write(shard)
+		if err != nil && result == nil {
+			result = err
+		}
+	}
+
+	return result
+}
+
+// close closes the buffers and nodes of the cluster.
+func (s *ClusterSink) close() error {
+	var result error
+	for _, b := range s.buffers {
+		// the buffer closes its node
+		err := b.Close()
+		if err != nil && result == nil {
+			result = err
+		}
+	}
+	if len(s.buffers) > 0 {
+		return result
+	}
+
+	for _, n := range s.nodes {
+		err := n.Close()
+		if err != nil && result == nil {
+			result = err
+		}
+	}
+
+	return result
+}
+
+// setHealthy updates the health of the node and logs changes.
+func (n *influxNode) setHealthy(err error) {
+	n.Lock()
+	defer n.Unlock()
+
+	healthy := err == nil
+	if healthy == n.healthy {
+		return
+	}
+
+	n.healthy = healthy
+	if healthy {
+		n.metric.Set(1)
+		logrus.Infof("%s: node %s is healthy", n.Name, n.Addr)
+	} else {
+		n.metric.Set(0)
+		logrus.Warnf("%s: node %s is unhealthy: %s", n.Name, n.Addr, err.Error())
+	}
+}
+
+// isHealthy returns true if the last write or health check succeeded.
+func (n *influxNode) isHealthy() bool {
+	n.Lock()
+	defer n.Unlock()
+
+	return n.healthy
+}
+
+// ---------------------------------------------------------------------------------------
+//  private functions
+// ---------------------------------------------------------------------------------------
+
+// newInfluxNode creates a client for a single address of the output.
+// Nodes are considered healthy until a write or health check fails.
+func newInfluxNode(name, addr string, conf ConfInflux, timeout time.Duration) (*influxNode, error) {
+	conf.Addrs = nil
+	conf.Addr = addr
+	conf.URL = ""
+
+	c, err := NewInfluxClient(&conf, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	n := influxNode{
+		Name:    name,
+		Addr:    addr,
+		client:  c,
+		healthy: true,
+		metric:  new(expvar.Int),
+	}
+	n.metric.Set(1)
+	nodeStats.Set(name+" node "+addr, n.metric)
+
+	return &n, nil
+}
@@ -0,0 +1,369 @@
+package main
+
+// sysflux
+// Copyright (C) 2018 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/sirupsen/logrus"
+)
+
+// --------------------------------------------------------------------------------------
+//  constants
+// --------------------------------------------------------------------------------------
+
+const (
+	FormatLineProtocol = "line"
+	FormatJSON         = "json"
+
+	// sortable suffix of rotated files
+	rotateTimeFormat = "20060102T150405.000"
+)
+
+// ---------------------------------------------------------------------------------------
+//  types
+// ---------------------------------------------------------------------------------------
+
+// FileSink appends points to a file in the line protocol or as json lines.
+// The file is rotated when it exceeds the maximum size or age. Rotated
+// files are optionally compressed and removed by count and age.
+type FileSink struct {
+	Conf ConfFile
+
+	// internal variables
+	file     *os.File
+	size     int64
+	opened   time.Time
+	cleanup  sync.WaitGroup
+	cleaning sync.Mutex
+	sync.Mutex
+}
+
+// rotatedFile is a file rotated by the file sink.
+type rotatedFile struct {
+	path    string
+	time    time.Time
+	counter int
+}
+
+// pointJSON is the json representation of a point.
+type pointJSON struct {
+	Measurement string                 `json:"measurement"`
+	Tags        map[string]string      `json:"tags"`
+	Fields      map[string]interface{} `json:"fields"`
+	Time        time.Time              `json:"time"`
+}
+
+// ---------------------------------------------------------------------------------------
+//  public functions
+// ---------------------------------------------------------------------------------------
+
+// NewFileSink creates a new file sink and opens the file for appending.
+func NewFileSink(conf *ConfFile) (*FileSink, error) {
+	sink := FileSink{Conf: *conf}
+
+	err := os.MkdirAll(filepath.Dir(conf.Path), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	err = sink.open()
+	if err != nil {
+		return nil, err
+	}
+
+	return &sink, nil
+}
+
+// FormatPoints formats the points in the line protocol or as json lines.
+// The json output is indented if pretty is set.
+func FormatPoints(points []*client.Point, format string, pretty bool) ([]byte, error) {
+	var buf strings.Builder
+	for _, pt := range points {
+		if format != FormatJSON {
+			buf.WriteString(pt.String())
+			buf.WriteByte('\n')
+			continue
+		}
+
+		var line []byte
+		var err error
+		p := pointJSON{pt.Name(), pt.Tags(), pt.Fields(), pt.Time()}
+		if pretty {
+			line, err = json.MarshalIndent(p, "", "  ")
+		} else {
+			line, err = json.Marshal(p)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+
+	return []byte(buf.String()), nil
+}
+
+// ---------------------------------------------------------------------------------------
+//  public members
+// ---------------------------------------------------------------------------------------
+
+// Write appends the points to the file, which is rotated beforehand if necessary.
+func (s *FileSink) Write(bp client.BatchPoints) error {
+	buf, err := FormatPoints(bp.Points(), s.Conf.Format, false)
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.needsRotation(int64(len(buf))) {
+		err := s.rotate()
+		if err != nil {
+			return err
+		}
+	}
+
+	n, err := s.file.Write(buf)
+	s.size += int64(n)
+
+	return err
+}
+
+// Close closes the file and waits for the compression of rotated files.
+func (s *FileSink) Close() error {
+	s.Lock()
+	err := s.file.Close()
+	s.Unlock()
+
+	s.cleanup.Wait()
+	return err
+}
+
+// ---------------------------------------------------------------------------------------
+//  private members
+// ---------------------------------------------------------------------------------------
+
+// open opens the file for appending.
+func (s *FileSink) open() error {
+	file, err := os.OpenFile(s.Conf.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	s.file = file
+	s.size = info.Size()
+	s.opened = time.Now()
+
+	return nil
+}
+
+// needsRotation returns true if the file has to be rotated
+// before the given amount of bytes is written.
+func (s *FileSink) needsRotation(n int64) bool {
+	if s.size < 1 {
+		return false
+	}
+
+	return (s.Conf.MaxSize > 0 && s.size+n > s.Conf.MaxSize) ||
+		(s.Conf.RotateInterval > 0 && time.Since(s.opened) >= s.Conf.RotateInterval)
+}
+
+// rotate renames the current file and opens a new one. The compression
+// of the rotated file and the cleanup run in the background. If the file
+// can not be renamed, writing continues with the current file.
+func (s *FileSink) rotate() error {
+	err := s.file.Close()
+	if err != nil {
+		return err
+	}
+
+	rotated := s.rotatedName(time.Now())
+	err = os.Rename(s.Conf.Path, rotated)
+	if err != nil {
+		logrus.Errorf("failed to rotate %s: %s", s.Conf.Path, err.Error())
+		return s.open()
+	}
+
+	s.cleanup.Add(1)
+	go func() {
+		defer s.cleanup.Done()
+
+		s.cleaning.Lock()
+		defer s.cleaning.Unlock()
+
+		if s.Conf.Compress {
+			err := compressFile(rotated)
+			if err != nil {
+				logrus.Errorf("failed to compress %s: %s", rotated, err.Error())
+			}
+		}
+		s.removeOldFiles()
+	}()
+
+	return s.open()
+}
+
+// removeOldFiles removes the rotated files which exceed
+// the maximum number of files or the maximum age.
+func (s *FileSink) removeOldFiles() {
+	if s.Conf.MaxFiles < 1 && s.Conf.MaxAge <= 0 {
+		return
+	}
+
+	matches, err := filepath.Glob(s.Conf.Path + ".*")
+	if err != nil {
+		logrus.Errorln("failed to list rotated files:", err.Error())
+		return
+	}
+
+	// other files starting with the path are left alone
+	files := make([]rotatedFile, 0, len(matches))
+	for _, path := range matches {
+		file, ok := s.parseRotated(path)
+		if ok {
+			files = append(files, file)
+		}
+	}
+
+	// newest first
+	sort.Slice(files, func(i, j int) bool {
+		if !files[i].time.Equal(files[j].time) {
+			return files[i].time.After(files[j].time)
+		}
+		return files[i].counter > files[j].counter
+	})
+
+	for i, file := range files {
+		remove := s.Conf.MaxFiles > 0 && i >= s.Conf.MaxFiles
+		if !remove && s.Conf.MaxAge > 0 {
+			info, err := os.Stat(file.path)
+			remove = err == nil && time.Since(info.ModTime()) > s.Conf.MaxAge
+		}
+
+		if remove {
+			err := os.Remove(file.path)
+			if err != nil {
+				logrus.Errorf("failed to remove %s: %s", file.path, err.Error())
+			}
+		}
+	}
+}
+
+// rotatedName returns an unused name for the file rotated at the given
+// time. A counter is appended if the name has been used already.
+func (s *FileSink) rotatedName(now time.Time) string {
+	base := s.Conf.Path + "." + now.Format(rotateTimeFormat)
+
+	name := base
+	for i := 1; fileExists(name) || fileExists(name+".gz"); i++ {
+		name = base + "_" + strconv.Itoa(i)
+	}
+
+	return name
+}
+
+// parseRotated parses the name of a rotated file, which is
+// <path>.<time>[_<counter>][.gz]. False is returned for other files.
+func (s *FileSink) parseRotated(path string) (rotatedFile, bool) {
+	suffix := strings.TrimSuffix(strings.TrimPrefix(path, s.Conf.Path+"."), ".gz")
+
+	counter := 0
+	if i := strings.IndexByte(suffix, '_'); i >= 0 {
+		var err error
+		counter, err = strconv.Atoi(suffix[i+1:])
+		if err != nil || counter < 1 {
+			return rotatedFile{}, false
+		}
+		suffix = suffix[:i]
+	}
+
+	t, err := time.ParseInLocation(rotateTimeFormat, suffix, time.Local)
+	if err != nil || t.Format(rotateTimeFormat) != suffix {
+		return rotatedFile{}, false
+	}
+
+	return rotatedFile{path: path, time: t, counter: counter}, true
+}
+
+// ---------------------------------------------------------------------------------------
+//  private functions
+// ---------------------------------------------------------------------------------------
+
+// fileExists returns true if the path exists.
+func fileExists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+// compressFile replaces the file by a gzip compressed copy.
+func compressFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp := path + ".gz.tmp"
+	dst, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	w := gzip.NewWriter(dst)
+	_, err = io.Copy(w, bufio.NewReader(src))
+	if err == nil {
+		err = w.Close()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	err = os.Rename(tmp, path+".gz")
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(path)
+}
@@ -0,0 +1,198 @@
+package main
+
+// sysflux
+// Copyright (C) 2018 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+// ---------------------------------------------------------------------------------------
+//  types
+// ---------------------------------------------------------------------------------------
+
+// GraphiteSink sends points in the graphite plaintext protocol. Every field
+// of a point becomes a metric whose path is built from the template.
+// In tagged mode the tags of the point are appended in the graphite 1.1
+// tag syntax "path;tag=value".
+type GraphiteSink struct {
+	Conf ConfGraphite
+
+	// internal variables
+	template *Template
+	writer   *LineWriter
+}
+
+// ---------------------------------------------------------------------------------------
+//  public functions
+// ---------------------------------------------------------------------------------------
+
+// NewGraphiteSink creates a new graphite sink. The connection is
+// established in the background when the first points are written.
+func NewGraphiteSink(conf *ConfOutput, timeout time.Duration) (*GraphiteSink, error) {
+	template, err := compileGraphiteTemplate(conf.Template)
+	if err != nil {
+		return nil, err
+	}
+
+	return &GraphiteSink{
+		Conf:     conf.ConfGraphite,
+		template: template,
+		writer:   NewLineWriter(conf.Addr, conf.BufferSize, timeout),
+	}, nil
+}
+
+// ---------------------------------------------------------------------------------------
+//  public members
+// ---------------------------------------------------------------------------------------
+
+// Write converts the points into graphite metrics and enqueues them
+// for sending. Fields which are not numeric are skipped.
+func (s *GraphiteSink) Write(bp client.BatchPoints) error {
+	lines := make([][]byte, 0, len(bp.Points()))
+	for _, pt := range bp.Points() {
+		lines = s.appendLines(lines, pt)
+	}
+
+	if len(lines) > 0 {
+		s.writer.Write(lines)
+	}
+
+	return nil
+}
+
+// Drain sends the enqueued lines until the deadline and
+// returns the number of discarded lines.
+func (s *GraphiteSink) Drain(deadline time.Time) int {
+	return s.writer.Drain(deadline)
+}
+
+// Close closes the connection to the graphite server.
+func (s *GraphiteSink) Close() error {
+	return s.writer.Close()
+}
+
+// ---------------------------------------------------------------------------------------
+//  private members
+// ---------------------------------------------------------------------------------------
+
+// appendLines appends a line for every numeric field of the point.
+func (s *GraphiteSink) appendLines(lines [][]byte, pt *client.Point) [][]byte {
+	names := make([]string, 0, len(pt.Tags()))
+	for name := range pt.Tags() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	vars := make(map[string]string, len(names)+3)
+	vars["measurement"] = graphiteSanitize(pt.Name(), false)
+
+	values := make([]string, len(names))
+	var tags strings.Builder
+	for i, name := range names {
+		values[i] = graphiteSanitize(pt.Tags()[name], false)
+		vars[PrefixTag+name] = values[i]
+
+		if s.Conf.Tagged && values[i] != "" {
+			tags.WriteString(";" + graphiteSanitize(name, true) + "=" + values[i])
+		}
+	}
+	vars["tags"] = strings.Join(values, ".")
+
+	timestamp := " " + strconv.FormatInt(pt.Time().Unix(), 10) + "\n"
+	for field, v := range pt.Fields() {
+		value, err := toNumber(v)
+		if err != nil {
+			continue
+		}
+
+		vars["field"] = graphiteSanitize(field, false)
+		path := graphitePath(s.template.Execute(vars))
+		if path == "" {
+			continue
+		}
+
+		line := path + tags.String() + " " + strconv.FormatFloat(value, 'f', -1, 64) + timestamp
+		lines = append(lines, []byte(line))
+	}
+
+	return lines
+}
+
+// ---------------------------------------------------------------------------------------
+//  private functions
+// ---------------------------------------------------------------------------------------
+
+// compileGraphiteTemplate compiles a metric path template. Valid placeholders
+// are {measurement}, {field}, {tags} and {tag_<name>}.
+func compileGraphiteTemplate(src string) (*Template, error) {
+	t, err := CompileTemplate(src, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range t.names {
+		switch {
+		case name == "measurement", name == "field", name == "tags":
+		case strings.HasPrefix(name, PrefixTag) && len(name) > len(PrefixTag):
+		default:
+			return nil, errors.New("unknown placeholder {" + name + "} in template \"" + src + "\"")
+		}
+	}
+
+	return t, nil
+}
+
+// graphiteSanitize replaces all characters which are not allowed in
+// a path node or tag by an underscore. Dots are only kept in tag names,
+// because they would split the value into several path nodes.
+func graphiteSanitize(s string, tag bool) string {
+	b := []byte(s)
+	for i, c := range b {
+		valid := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == ':' || (c == '.' && tag)
+		if !valid {
+			b[i] = '_'
+		}
+	}
+
+	return string(b)
+}
+
+// graphitePath removes the empty nodes of a metric path,
+// which are caused by empty placeholders.
+func graphitePath(path string) string {
+	nodes := strings.Split(path, ".")
+	n := 0
+	for _, node := range nodes {
+		if node != "" {
+			nodes[n] = node
+			n++
+		}
+	}
+
+	return strings.Join(nodes[:n], ".")
+}
@@ -0,0 +1,302 @@
+package main
+
+// sysflux
+// Copyright (C) 2018 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+// --------------------------------------------------------------------------------------
+//  constants
+// --------------------------------------------------------------------------------------
+
+const (
+	ProtocolTelnet = "telnet"
+
+	// opentsdb requires every data point to have a tag
+	openTSDBFallbackTag = "host"
+)
+
+// ---------------------------------------------------------------------------------------
+//  types
+// ---------------------------------------------------------------------------------------
+
+// OpenTSDBSink sends points to OpenTSDB using either the telnet put
+// protocol or the http api. Every field of a point becomes a data point
+// of the metric <measurement>.<field> with the tags of the point. Points
+// without tags are tagged with the hostname of sysflux.
+type OpenTSDBSink struct {
+	// internal variables
+	writer      *LineWriter
+	url         string
+	user        string
+	password    string
+	maxBodySize int
+	hostname    string
+	httpClient  *http.Client
+	transport   *http.Transport
+}
+
+type openTSDBPoint struct {
+	Metric    string            `json:"metric"`
+	Timestamp int64             `json:"timestamp"`
+	Value     float64           `json:"value"`
+	Tags      map[string]string `json:"tags"`
+}
+
+// ---------------------------------------------------------------------------------------
+//  public functions
+// ---------------------------------------------------------------------------------------
+
+// NewOpenTSDBSink creates a new opentsdb sink speaking the configured protocol.
+func NewOpenTSDBSink(conf *ConfOutput, timeout time.Duration) (*OpenTSDBSink, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	hostname = openTSDBSanitize(hostname)
+
+	if conf.Protocol == ProtocolHTTP {
+		transport, err := NewHTTPTransport(&conf.TLS, conf.URL)
+		if err != nil {
+			return nil, err
+		}
+
+		return &OpenTSDBSink{
+			url:         strings.TrimSuffix(conf.URL, "/") + "/api/put",
+			user:        conf.User,
+			password:    conf.Password,
+			maxBodySize: conf.MaxBodySize,
+			hostname:    hostname,
+			httpClient:  &http.Client{Timeout: timeout, Transport: transport},
+			transport:   transport,
+		}, nil
+	}
+
+	return &OpenTSDBSink{
+		writer:   NewLineWriter(conf.Addr, conf.BufferSize, timeout),
+		hostname: hostname,
+	}, nil
+}
+
+// ---------------------------------------------------------------------------------------
+//  public members
+// ---------------------------------------------------------------------------------------
+
+// Write sends the numeric fields of all points. Telnet lines are enqueued
+// for sending in the background, the http api receives the batch in as
+// many requests as required by the maximum body size.
+func (s *OpenTSDBSink) Write(bp client.BatchPoints) error {
+	points := openTSDBPoints(bp.Points(), s.hostname)
+	if len(points) < 1 {
+		return nil
+	}
+
+	if s.writer == nil {
+		bodies, err := splitJSON(points, s.maxBodySize)
+		if err != nil {
+			return PermanentError{err}
+		}
+		for _, body := range bodies {
+			err = s.post(body)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	lines := make([][]byte, len(points))
+	for i, p := range points {
+		lines[i] = []byte(p.String())
+	}
+	s.writer.Write(lines)
+
+	return nil
+}
+
+// Drain sends the enqueued telnet lines until the deadline and
+// returns the number of discarded lines.
+func (s *OpenTSDBSink) Drain(deadline time.Time) int {
+	if s.writer == nil {
+		return 0
+	}
+
+	return s.writer.Drain(deadline)
+}
+
+// Close releases the resources of the sink.
+func (s *OpenTSDBSink) Close() error {
+	if s.writer != nil {
+		return s.writer.Close()
+	}
+
+	s.transport.CloseIdleConnections()
+	return nil
+}
+
+// String formats the data point as telnet put command.
+func (p *openTSDBPoint) String() string {
+	var b strings.Builder
+	b.WriteString("put " + p.Metric + " " + strconv.FormatInt(p.Timestamp, 10) + " " +
+		strconv.FormatFloat(p.Value, 'f', -1, 64))
+
+	names := make([]string, 0, len(p.Tags))
+	for name := range p.Tags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		b.WriteString(" " + name + "=" + p.Tags[name])
+	}
+	b.WriteByte('\n')
+
+	return b.String()
+}
+
+// ---------------------------------------------------------------------------------------
+//  private members
+// ---------------------------------------------------------------------------------------
+
+// post sends a json array of data points to the http api.
+// Rejected data points are not worth a retry.
+func (s *OpenTSDBSink) post(body []byte) error {
+	req, err := http.NewRequest("POST", s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", UserAgent)
+	if s.user != "" {
+		req.SetBasicAuth(s.user, s.password)
+	}
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	msg, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+
+	err = fmt.Errorf("opentsdb responded with %s: %s",
+		resp.Status, strings.TrimSpace(string(msg)))
+	if resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusTooManyRequests {
+		return PermanentError{err}
+	}
+
+	return err
+}
+
+// ---------------------------------------------------------------------------------------
+//  private functions
+// ---------------------------------------------------------------------------------------
+
+// openTSDBPoints converts the numeric fields of the points into
+// opentsdb data points with millisecond timestamps. Points without
+// tags are tagged with the given hostname.
+func openTSDBPoints(points []*client.Point, hostname string) []*openTSDBPoint {
+	result := make([]*openTSDBPoint, 0, len(points))
+
+	for _, pt := range points {
+		tags := make(map[string]string, len(pt.Tags()))
+		for name, value := range pt.Tags() {
+			if value != "" {
+				tags[openTSDBSanitize(name)] = openTSDBSanitize(value)
+			}
+		}
+		if len(tags) < 1 {
+			tags[openTSDBFallbackTag] = hostname
+		}
+
+		timestamp := pt.Time().UnixNano() / int64(time.Millisecond)
+		for field, v := range pt.Fields() {
+			value, err := toNumber(v)
+			if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+				continue
+			}
+
+			result = append(result, &openTSDBPoint{
+				Metric:    openTSDBSanitize(pt.Name() + "." + field),
+				Timestamp: timestamp,
+				Value:     value,
+				Tags:      tags,
+			})
+		}
+	}
+
+	return result
+}
+
+// splitJSON encodes the data points as json arrays of at most maxSize
+// bytes. A data point exceeding the maximum size on its own is put into
+// a separate array.
+func splitJSON(points []*openTSDBPoint, maxSize int) ([][]byte, error) {
+	bodies := make([][]byte, 0, 1)
+	body := []byte{'['}
+	for _, p := range points {
+		item, err := json.Marshal(p)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(body) > 1 && len(body)+len(item)+1 > maxSize {
+			bodies = append(bodies, append(body, ']'))
+			body = []byte{'['}
+		}
+		if len(body) > 1 {
+			body = append(body, ',')
+		}
+		body = append(body, item...)
+	}
+
+	return append(bodies, append(body, ']')), nil
+}
+
+// openTSDBSanitize replaces all characters which are not allowed
+// in metric names and tags by an underscore.
+func openTSDBSanitize(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		valid := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '/'
+		if !valid {
+			b[i] = '_'
+		}
+	}
+
+	return string(b)
+}
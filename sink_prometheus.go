@@ -0,0 +1,428 @@
+package main
+
+// sysflux
+// Copyright (C) 2018 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"bytes"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/sirupsen/logrus"
+)
+
+// ---------------------------------------------------------------------------------------
+//  constants
+// ---------------------------------------------------------------------------------------
+
+// DefaultPrometheusBuckets are the default histogram
+// buckets of the prometheus client libraries.
+var DefaultPrometheusBuckets = []float64{
+	.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10,
+}
+
+// promNameLabel is the label holding the metric name
+const promNameLabel = "__name__"
+
+var promLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// ---------------------------------------------------------------------------------------
+//  types
+// ---------------------------------------------------------------------------------------
+
+// PrometheusSink converts points into prometheus metrics
+// which are exposed on a http endpoint.
+type PrometheusSink struct {
+	Conf ConfPrometheus
+
+	// internal variables
+	metrics map[string]*promMetric
+	server  *http.Server
+	done    chan struct{}
+	sync.Mutex
+}
+
+type promMetric struct {
+	name    string
+	help    string
+	typ     string
+	buckets []float64
+	series  map[string]*promSeries
+}
+
+type promSeries struct {
+	labels  string
+	value   float64
+	counts  []uint64
+	count   uint64
+	sum     float64
+	updated time.Time
+}
+
+// ---------------------------------------------------------------------------------------
+//  public functions
+// ---------------------------------------------------------------------------------------
+
+// NewPrometheusSink creates a new prometheus sink and starts
+// the http server of the metrics endpoint.
+func NewPrometheusSink(conf *ConfPrometheus) (*PrometheusSink, error) {
+	listener, err := net.Listen("tcp", conf.Listen)
+	if err != nil {
+		return nil, err
+	}
+
+	sink := PrometheusSink{
+		Conf:    *conf,
+		metrics: make(map[string]*promMetric),
+		done:    make(chan struct{}),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(conf.Path, sink.serveMetrics)
+	sink.server = &http.Server{Handler: mux}
+
+	go func() {
+		err := sink.server.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			logrus.Errorln("prometheus endpoint failed:", err.Error())
+		}
+	}()
+	go sink.expire()
+
+	logrus.Infof("serving prometheus metrics on %s%s", conf.Listen, conf.Path)
+
+	return &sink, nil
+}
+
+// ---------------------------------------------------------------------------------------
+//  public members
+// ---------------------------------------------------------------------------------------
+
+// Write updates the metrics with the fields of all points.
+func (s *PrometheusSink) Write(bp client.BatchPoints) error {
+	now := time.Now()
+
+	s.Lock()
+	defer s.Unlock()
+
+	for _, pt := range bp.Points() {
+		labels := s.labels(pt.Tags())
+
+		for field, v := range pt.Fields() {
+			value, err := toNumber(v)
+			if err != nil {
+				continue
+			}
+
+			metric := s.metric(pt.Name(), field)
+			if metric == nil {
+				continue
+			}
+			metric.observe(labels, value, now)
+		}
+	}
+
+	return nil
+}
+
+// Close stops the http server of the metrics endpoint.
+func (s *PrometheusSink) Close() error {
+	close(s.done)
+	return s.server.Close()
+}
+
+// ---------------------------------------------------------------------------------------
+//  private members
+// ---------------------------------------------------------------------------------------
+
+// metric returns the metric of a field, which is created if necessary.
+// Nil is returned if the metric name is used with another type.
+func (s *PrometheusSink) metric(measurement, field string) *promMetric {
+	conf := ConfMetric{Type: MetricGauge}
+	for _, m := range s.Conf.Metrics {
+		if m.Field == field && (m.Measurement == "" || m.Measurement == measurement) {
+			conf = *m
+			break
+		}
+	}
+
+	name := conf.Name
+	if name == "" {
+		name = measurement + "_" + field
+	}
+	name = sanitizePromName(name, true)
+	if conf.Type == MetricCounter && !strings.HasSuffix(name, "_total") {
+		name += "_total"
+	}
+
+	metric, ok := s.metrics[name]
+	if ok {
+		if metric.typ != conf.Type {
+			return nil
+		}
+		return metric
+	}
+
+	metric = &promMetric{
+		name:   name,
+		help:   conf.Help,
+		typ:    conf.Type,
+		series: make(map[string]*promSeries),
+	}
+	if metric.help == "" {
+		metric.help = "Field " + field + " of measurement " + measurement
+	}
+
+	if metric.typ == MetricHistogram {
+		// the buckets are sorted without modifying the configuration
+		buckets := conf.Buckets
+		if len(buckets) < 1 {
+			buckets = DefaultPrometheusBuckets
+		}
+		metric.buckets = append([]float64(nil), buckets...)
+		sort.Float64s(metric.buckets)
+	}
+
+	s.metrics[name] = metric
+	return metric
+}
+
+// labels converts the tags of a point into the formatted label set of the
+// exposition format. Only the configured tags are used if a mapping exists.
+func (s *PrometheusSink) labels(tags map[string]string) string {
+	labels := uniqueLabels(tags, func(tag string) (string, bool) {
+		if len(s.Conf.Labels) < 1 {
+			return tag, true
+		}
+		name, ok := s.Conf.Labels[tag]
+		return name, ok
+	})
+
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + "=" + quoteLabelValue(labels[name])
+	}
+
+	return strings.Join(pairs, ",")
+}
+
+// serveMetrics writes all metrics in the prometheus text exposition format.
+func (s *PrometheusSink) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+
+	s.Lock()
+	names := make([]string, 0, len(s.metrics))
+	for name := range s.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		s.metrics[name].format(&buf)
+	}
+	s.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
+
+// expire periodically removes series which have not been updated
+// within the configured expiry duration.
+func (s *PrometheusSink) expire() {
+	ticker := time.NewTicker(s.Conf.Expire / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+
+		case now := <-ticker.C:
+			s.Lock()
+			for name, metric := range s.metrics {
+				for key, series := range metric.series {
+					if now.Sub(series.updated) > s.Conf.Expire {
+						delete(metric.series, key)
+					}
+				}
+
+				if len(metric.series) < 1 {
+					delete(s.metrics, name)
+				}
+			}
+			s.Unlock()
+		}
+	}
+}
+
+// observe updates the series with the given labels.
+func (m *promMetric) observe(labels string, value float64, now time.Time) {
+	series, ok := m.series[labels]
+	if !ok {
+		series = &promSeries{labels: labels, counts: make([]uint64, len(m.buckets))}
+		m.series[labels] = series
+	}
+	series.updated = now
+
+	switch m.typ {
+	case MetricCounter:
+		// counters can only increase
+		if value > 0 {
+			series.value += value
+		}
+
+	case MetricGauge:
+		series.value = value
+
+	case MetricHistogram:
+		for i, upper := range m.buckets {
+			if value <= upper {
+				series.counts[i]++
+			}
+		}
+		series.count++
+		series.sum += value
+	}
+}
+
+// format writes the metric in the prometheus text exposition format.
+func (m *promMetric) format(buf *bytes.Buffer) {
+	buf.WriteString("# HELP " + m.name + " " + strings.Replace(m.help, "\n", " ", -1) + "\n")
+	buf.WriteString("# TYPE " + m.name + " " + m.typ + "\n")
+
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		series := m.series[key]
+
+		if m.typ != MetricHistogram {
+			writeSample(buf, m.name, series.labels, series.value)
+			continue
+		}
+
+		for i, upper := range m.buckets {
+			writeSample(buf, m.name+"_bucket", joinLabels(series.labels,
+				"le="+quoteLabelValue(formatFloat(upper))), float64(series.counts[i]))
+		}
+		writeSample(buf, m.name+"_bucket", joinLabels(series.labels, `le="+Inf"`),
+			float64(series.count))
+		writeSample(buf, m.name+"_sum", series.labels, series.sum)
+		writeSample(buf, m.name+"_count", series.labels, float64(series.count))
+	}
+}
+
+// ---------------------------------------------------------------------------------------
+//  private functions
+// ---------------------------------------------------------------------------------------
+
+func writeSample(buf *bytes.Buffer, name, labels string, value float64) {
+	buf.WriteString(name)
+	if labels != "" {
+		buf.WriteString("{" + labels + "}")
+	}
+	buf.WriteString(" " + formatFloat(value) + "\n")
+}
+
+func joinLabels(labels, label string) string {
+	if labels == "" {
+		return label
+	}
+	return labels + "," + label
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// uniqueLabels converts tags into labels with the names returned by rename,
+// tags for which rename returns false are skipped. Names whose sanitized form
+// collides with another label or the metric name label are made unique by a
+// numeric suffix, in the order of the tag names.
+func uniqueLabels(tags map[string]string, rename func(tag string) (string, bool)) map[string]string {
+	tagNames := make([]string, 0, len(tags))
+	for tag := range tags {
+		tagNames = append(tagNames, tag)
+	}
+	sort.Strings(tagNames)
+
+	labels := make(map[string]string, len(tags))
+	for _, tag := range tagNames {
+		name, ok := rename(tag)
+		if !ok {
+			continue
+		}
+
+		name = sanitizePromName(name, false)
+		unique := name
+		for i := 2; ; i++ {
+			if _, ok := labels[unique]; !ok && unique != promNameLabel {
+				break
+			}
+			unique = name + "_" + strconv.Itoa(i)
+		}
+		labels[unique] = tags[tag]
+	}
+
+	return labels
+}
+
+// quoteLabelValue quotes and escapes a label value.
+func quoteLabelValue(value string) string {
+	return `"` + promLabelEscaper.Replace(value) + `"`
+}
+
+// sanitizePromName converts the given string into a valid prometheus metric
+// or label name. Colons are only allowed in metric names.
+func sanitizePromName(name string, metric bool) string {
+	b := []byte(name)
+	for i, c := range b {
+		valid := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c == '_' ||
+			(c >= '0' && c <= '9' && i > 0) || (c == ':' && metric)
+		if !valid {
+			b[i] = '_'
+		}
+	}
+
+	return string(b)
+}
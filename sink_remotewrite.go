@@ -0,0 +1,339 @@
+package main
+
+// sysflux
+// Copyright (C) 2018 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/sirupsen/logrus"
+)
+
+// --------------------------------------------------------------------------------------
+//  constants
+// --------------------------------------------------------------------------------------
+
+const (
+	RemoteWriteVersion = "0.1.0"
+
+	// protobuf wire types
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+)
+
+// ---------------------------------------------------------------------------------------
+//  types
+// ---------------------------------------------------------------------------------------
+
+// RemoteWriteSink pushes points to a prometheus remote write endpoint.
+// Every field of a point becomes a sample of the series
+// <measurement>_<field> labeled with the tags of the point.
+type RemoteWriteSink struct {
+	Conf ConfRemoteWrite
+
+	// internal variables
+	url        string
+	user       string
+	password   string
+	token      string
+	httpClient *http.Client
+	transport  *http.Transport
+}
+
+type promTimeSeries struct {
+	labels  []promLabel
+	samples []promSample
+}
+
+type promLabel struct {
+	name  string
+	value string
+}
+
+type promSample struct {
+	value     float64
+	timestamp int64
+}
+
+// ---------------------------------------------------------------------------------------
+//  public functions
+// ---------------------------------------------------------------------------------------
+
+// NewRemoteWriteSink creates a new remote write sink.
+func NewRemoteWriteSink(conf *ConfOutput, timeout time.Duration) (*RemoteWriteSink, error) {
+	token, err := conf.ConfInflux.token()
+	if err != nil {
+		return nil, err
+	}
+
+	transport, err := NewHTTPTransport(&conf.TLS, conf.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RemoteWriteSink{
+		Conf:       conf.ConfRemoteWrite,
+		url:        conf.URL,
+		user:       conf.User,
+		password:   conf.Password,
+		token:      token,
+		httpClient: &http.Client{Timeout: timeout, Transport: transport},
+		transport:  transport,
+	}, nil
+}
+
+// ---------------------------------------------------------------------------------------
+//  public members
+// ---------------------------------------------------------------------------------------
+
+// Write sends the points of the batch to the remote write endpoint.
+// Failed requests are retried by the buffer of the output. Series
+// rejected by the endpoint are dropped and logged.
+func (s *RemoteWriteSink) Write(bp client.BatchPoints) error {
+	series := remoteWriteSeries(bp.Points())
+	if len(series) < 1 {
+		return nil
+	}
+
+	rejected, err := s.write(series)
+	if rejected > 0 {
+		logrus.Warnf("remote write endpoint rejected %d of %d samples",
+			rejected, countSamples(series))
+	}
+
+	return err
+}
+
+// Close releases the resources of the sink.
+func (s *RemoteWriteSink) Close() error {
+	s.transport.CloseIdleConnections()
+	return nil
+}
+
+// ---------------------------------------------------------------------------------------
+//  private members
+// ---------------------------------------------------------------------------------------
+
+// write sends the series. If the endpoint rejects the request as invalid,
+// the series are split in halves and sent again, until the rejected series
+// are isolated. The number of rejected samples is returned, an error is
+// only returned if the request should be retried.
+func (s *RemoteWriteSink) write(series []*promTimeSeries) (int, error) {
+	err := s.send(SnappyEncode(encodeWriteRequest(series)))
+	if _, permanent := err.(PermanentError); !permanent {
+		return 0, err
+	}
+
+	if len(series) == 1 {
+		logrus.Warnf("remote write endpoint rejected series %s: %s",
+			seriesName(series[0]), err.Error())
+		return len(series[0].samples), nil
+	}
+
+	half := len(series) / 2
+	first, err := s.write(series[:half])
+	if err != nil {
+		return first, err
+	}
+	second, err := s.write(series[half:])
+
+	return first + second, err
+}
+
+// send executes a single remote write request.
+func (s *RemoteWriteSink) send(body []byte) error {
+	req, err := http.NewRequest("POST", s.url, bytes.NewReader(body))
+	if err != nil {
+		return PermanentError{err}
+	}
+
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", UserAgent)
+	req.Header.Set("X-Prometheus-Remote-Write-Version", RemoteWriteVersion)
+	for k, v := range s.Conf.Headers {
+		req.Header.Set(k, v)
+	}
+
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	} else if s.user != "" {
+		req.SetBasicAuth(s.user, s.password)
+	}
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	msg, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+
+	err = fmt.Errorf("remote write endpoint responded with %s: %s",
+		resp.Status, strings.TrimSpace(string(msg)))
+
+	// server errors and rate limiting are worth a retry
+	if resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests {
+		return err
+	}
+
+	return PermanentError{err}
+}
+
+// ---------------------------------------------------------------------------------------
+//  private functions
+// ---------------------------------------------------------------------------------------
+
+// remoteWriteSeries converts the points into time series. Samples
+// of the same series are grouped in the order of the points.
+func remoteWriteSeries(points []*client.Point) []*promTimeSeries {
+	series := make([]*promTimeSeries, 0)
+	index := make(map[string]*promTimeSeries)
+
+	for _, pt := range points {
+		// labels must be sorted by name
+		unique := uniqueLabels(pt.Tags(), func(tag string) (string, bool) {
+			return tag, true
+		})
+		labels := make([]promLabel, 0, len(unique)+1)
+		for name, value := range unique {
+			labels = append(labels, promLabel{name, value})
+		}
+		sort.Slice(labels, func(i, j int) bool {
+			return labels[i].name < labels[j].name
+		})
+
+		timestamp := pt.Time().UnixNano() / int64(time.Millisecond)
+		for field, v := range pt.Fields() {
+			value, err := toNumber(v)
+			if err != nil {
+				continue
+			}
+
+			name := promLabel{promNameLabel, sanitizePromName(pt.Name()+"_"+field, true)}
+			seriesLabels := append([]promLabel{name}, labels...)
+
+			key := seriesKey(seriesLabels)
+			ts, ok := index[key]
+			if !ok {
+				ts = &promTimeSeries{labels: seriesLabels}
+				index[key] = ts
+				series = append(series, ts)
+			}
+			ts.samples = append(ts.samples, promSample{value, timestamp})
+		}
+	}
+
+	return series
+}
+
+// countSamples returns the number of samples of all series.
+func countSamples(series []*promTimeSeries) int {
+	samples := 0
+	for _, ts := range series {
+		samples += len(ts.samples)
+	}
+
+	return samples
+}
+
+// seriesName returns the value of the name label of the series.
+func seriesName(ts *promTimeSeries) string {
+	for _, l := range ts.labels {
+		if l.name == promNameLabel {
+			return l.value
+		}
+	}
+
+	return ""
+}
+
+func seriesKey(labels []promLabel) string {
+	var b strings.Builder
+	for _, l := range labels {
+		b.WriteString(l.name)
+		b.WriteByte(0)
+		b.WriteString(l.value)
+		b.WriteByte(0)
+	}
+
+	return b.String()
+}
+
+// encodeWriteRequest encodes the series as prometheus.WriteRequest message.
+func encodeWriteRequest(series []*promTimeSeries) []byte {
+	buf := make([]byte, 0, 1024)
+
+	for _, ts := range series {
+		msg := make([]byte, 0, 128)
+		for _, l := range ts.labels {
+			label := appendProtoBytes(nil, 1, []byte(l.name))
+			label = appendProtoBytes(label, 2, []byte(l.value))
+			msg = appendProtoBytes(msg, 1, label)
+		}
+
+		for _, s := range ts.samples {
+			sample := appendProtoTag(nil, 1, wireFixed64)
+			sample = appendFixed64(sample, math.Float64bits(s.value))
+			sample = appendProtoTag(sample, 2, wireVarint)
+			sample = appendVarint(sample, uint64(s.timestamp))
+			msg = appendProtoBytes(msg, 2, sample)
+		}
+
+		buf = appendProtoBytes(buf, 1, msg)
+	}
+
+	return buf
+}
+
+func appendProtoTag(buf []byte, field int, wireType int) []byte {
+	return appendVarint(buf, uint64(field<<3|wireType))
+}
+
+func appendProtoBytes(buf []byte, field int, data []byte) []byte {
+	buf = appendProtoTag(buf, field, wireBytes)
+	buf = appendVarint(buf, uint64(len(data)))
+	return append(buf, data...)
+}
+
+func appendVarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
+
+func appendFixed64(buf []byte, v uint64) []byte {
+	var tmp [8]byte
+	binary.LittleEndian.PutUint64(tmp[:], v)
+	return append(buf, tmp[:]...)
+}
@@ -0,0 +1,395 @@
+package main
+
+// sysflux
+// Copyright (C) 2018 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+// ---------------------------------------------------------------------------------------
+//  types
+// ---------------------------------------------------------------------------------------
+
+// remoteWriteReceiver decodes the received write requests
+// and rejects the series of a configured name.
+type remoteWriteReceiver struct {
+	reject string
+	status int
+
+	series   map[string][]promSample
+	requests int
+	sync.Mutex
+}
+
+// ---------------------------------------------------------------------------------------
+//  tests
+// ---------------------------------------------------------------------------------------
+
+func TestRemoteWriteEncoding(t *testing.T) {
+	receiver, sink := newRemoteWriteTest(t)
+
+	now := time.Unix(1700000000, 123000000)
+	err := sink.Write(remoteWriteBatch(t, now, map[string]string{"host": "a", "status": "200"},
+		map[string]interface{}{"duration": 1.5, "bytes": int64(42), "path": "/"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string][]promSample{
+		`{__name__="http_bytes",host="a",status="200"}`:    {{42, 1700000000123}},
+		`{__name__="http_duration",host="a",status="200"}`: {{1.5, 1700000000123}},
+	}
+	receiver.check(t, expected, 1)
+}
+
+func TestRemoteWriteSplitRejected(t *testing.T) {
+	receiver, sink := newRemoteWriteTest(t)
+	receiver.reject = "http_bad"
+
+	now := time.Unix(1700000000, 0)
+	err := sink.Write(remoteWriteBatch(t, now, map[string]string{"host": "a"},
+		map[string]interface{}{"a": 1.0, "b": 2.0, "bad": 3.0, "c": 4.0}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// only the rejected series is missing
+	expected := map[string][]promSample{
+		`{__name__="http_a",host="a"}`: {{1, 1700000000000}},
+		`{__name__="http_b",host="a"}`: {{2, 1700000000000}},
+		`{__name__="http_c",host="a"}`: {{4, 1700000000000}},
+	}
+	receiver.check(t, expected, -1)
+}
+
+func TestRemoteWriteCollidingTags(t *testing.T) {
+	receiver, sink := newRemoteWriteTest(t)
+
+	now := time.Unix(1700000000, 0)
+	err := sink.Write(remoteWriteBatch(t, now, map[string]string{"a-b": "1", "a_b": "2", "__name__": "x"},
+		map[string]interface{}{"a": 1.0}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string][]promSample{
+		`{__name__="http_a",__name___2="x",a_b="1",a_b_2="2"}`: {{1, 1700000000000}},
+	}
+	receiver.check(t, expected, 1)
+}
+
+func TestRemoteWriteServerError(t *testing.T) {
+	receiver, sink := newRemoteWriteTest(t)
+	receiver.status = http.StatusServiceUnavailable
+
+	err := sink.Write(remoteWriteBatch(t, time.Now(), nil, map[string]interface{}{"a": 1.0}))
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if _, permanent := err.(PermanentError); permanent {
+		t.Fatal("server errors must be retried:", err)
+	}
+	receiver.check(t, map[string][]promSample{}, 1)
+}
+
+// ---------------------------------------------------------------------------------------
+//  helpers
+// ---------------------------------------------------------------------------------------
+
+// newRemoteWriteTest starts a receiver and creates a sink writing to it.
+func newRemoteWriteTest(t *testing.T) (*remoteWriteReceiver, *RemoteWriteSink) {
+	receiver := &remoteWriteReceiver{series: make(map[string][]promSample)}
+	server := httptest.NewServer(receiver)
+	t.Cleanup(server.Close)
+
+	conf := ConfOutput{Type: OutputRemoteWrite}
+	conf.URL = server.URL
+	sink, err := NewRemoteWriteSink(&conf, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sink.Close() })
+
+	return receiver, sink
+}
+
+// remoteWriteBatch creates a batch with a point of the measurement http.
+func remoteWriteBatch(t *testing.T, timestamp time.Time, tags map[string]string, fields map[string]interface{}) client.BatchPoints {
+	bp, _ := client.NewBatchPoints(client.BatchPointsConfig{Precision: "ms"})
+	pt, err := client.NewPoint("http", tags, fields, timestamp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bp.AddPoint(pt)
+
+	return bp
+}
+
+func (r *remoteWriteReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.Lock()
+	defer r.Unlock()
+	r.requests++
+
+	if req.Header.Get("Content-Encoding") != "snappy" ||
+		req.Header.Get("Content-Type") != "application/x-protobuf" {
+		http.Error(w, "unexpected headers", http.StatusUnsupportedMediaType)
+		return
+	}
+	if r.status != 0 {
+		http.Error(w, "unavailable", r.status)
+		return
+	}
+
+	compressed, _ := ioutil.ReadAll(req.Body)
+	body, err := snappyDecode(compressed)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	series, err := decodeWriteRequest(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// like prometheus the whole request is rejected
+	for key := range series {
+		if r.reject != "" && strings.Contains(key, `__name__="`+r.reject+`"`) {
+			http.Error(w, "invalid sample", http.StatusBadRequest)
+			return
+		}
+	}
+	for key, samples := range series {
+		r.series[key] = append(r.series[key], samples...)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// check compares the received series and the number of requests,
+// a negative number of requests is not checked.
+func (r *remoteWriteReceiver) check(t *testing.T, expected map[string][]promSample, requests int) {
+	t.Helper()
+	r.Lock()
+	defer r.Unlock()
+
+	if requests >= 0 && r.requests != requests {
+		t.Errorf("received %d requests, expected %d", r.requests, requests)
+	}
+	if len(r.series) != len(expected) {
+		t.Errorf("received series %v, expected %v", r.series, expected)
+	}
+	for key, samples := range expected {
+		received := r.series[key]
+		if len(received) != len(samples) {
+			t.Errorf("series %s: received %v, expected %v", key, received, samples)
+			continue
+		}
+		for i := range samples {
+			if received[i] != samples[i] {
+				t.Errorf("series %s: received %v, expected %v", key, received, samples)
+			}
+		}
+	}
+}
+
+// snappyDecode decompresses a snappy block.
+func snappyDecode(src []byte) ([]byte, error) {
+	length, n := binary.Uvarint(src)
+	if n <= 0 {
+		return nil, errors.New("invalid length")
+	}
+	src = src[n:]
+
+	dst := make([]byte, 0, length)
+	for len(src) > 0 {
+		tag := src[0]
+		var size, offset int
+		switch tag & 0x03 {
+		case 0x00:
+			size = int(tag >> 2)
+			src = src[1:]
+			if size >= 60 {
+				bytes := size - 59
+				size = 0
+				for i := 0; i < bytes; i++ {
+					size |= int(src[i]) << (8 * uint(i))
+				}
+				src = src[bytes:]
+			}
+			size++
+			if size > len(src) {
+				return nil, errors.New("literal exceeds input")
+			}
+			dst = append(dst, src[:size]...)
+			src = src[size:]
+			continue
+
+		case 0x01:
+			size = 4 + int(tag>>2)&0x07
+			offset = int(tag&0xe0)<<3 | int(src[1])
+			src = src[2:]
+
+		case 0x02:
+			size = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(src[1:3]))
+			src = src[3:]
+
+		case 0x03:
+			size = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src[1:5]))
+			src = src[5:]
+		}
+
+		if offset <= 0 || offset > len(dst) {
+			return nil, errors.New("invalid copy offset")
+		}
+		for i := 0; i < size; i++ {
+			dst = append(dst, dst[len(dst)-offset])
+		}
+	}
+
+	if uint64(len(dst)) != length {
+		return nil, errors.New("length mismatch")
+	}
+
+	return dst, nil
+}
+
+// decodeWriteRequest decodes a prometheus.WriteRequest message into
+// samples keyed by the label set in the prometheus notation.
+func decodeWriteRequest(buf []byte) (map[string][]promSample, error) {
+	series := make(map[string][]promSample)
+	err := decodeProto(buf, func(field int, data []byte, _ uint64) error {
+		if field != 1 {
+			return nil
+		}
+
+		var labels []string
+		var samples []promSample
+		names := make(map[string]bool)
+		err := decodeProto(data, func(field int, data []byte, _ uint64) error {
+			switch field {
+			case 1:
+				var name, value string
+				err := decodeProto(data, func(field int, data []byte, _ uint64) error {
+					if field == 1 {
+						name = string(data)
+					} else if field == 2 {
+						value = string(data)
+					}
+					return nil
+				})
+				if names[name] {
+					return errors.New("duplicate label name " + name)
+				}
+				names[name] = true
+				labels = append(labels, name+`="`+value+`"`)
+				return err
+
+			case 2:
+				var sample promSample
+				err := decodeProto(data, func(field int, _ []byte, v uint64) error {
+					if field == 1 {
+						sample.value = math.Float64frombits(v)
+					} else if field == 2 {
+						sample.timestamp = int64(v)
+					}
+					return nil
+				})
+				samples = append(samples, sample)
+				return err
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		if !sort.StringsAreSorted(labels) {
+			return errors.New("labels are not sorted")
+		}
+		key := "{" + strings.Join(labels, ",") + "}"
+		series[key] = append(series[key], samples...)
+		return nil
+	})
+
+	return series, err
+}
+
+// decodeProto calls fn for every field of the message. Length delimited
+// fields are passed as data, varint and fixed64 fields as value.
+func decodeProto(buf []byte, fn func(field int, data []byte, value uint64) error) error {
+	for len(buf) > 0 {
+		key, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return errors.New("invalid field key")
+		}
+		buf = buf[n:]
+
+		var data []byte
+		var value uint64
+		switch key & 0x07 {
+		case wireVarint:
+			value, n = binary.Uvarint(buf)
+			if n <= 0 {
+				return errors.New("invalid varint")
+			}
+			buf = buf[n:]
+
+		case wireFixed64:
+			if len(buf) < 8 {
+				return errors.New("truncated fixed64")
+			}
+			value = binary.LittleEndian.Uint64(buf)
+			buf = buf[8:]
+
+		case wireBytes:
+			length, n := binary.Uvarint(buf)
+			if n <= 0 || uint64(len(buf)-n) < length {
+				return errors.New("truncated bytes")
+			}
+			data = buf[n : n+int(length)]
+			buf = buf[n+int(length):]
+
+		default:
+			return errors.New("unsupported wire type")
+		}
+
+		err := fn(int(key>>3), data, value)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
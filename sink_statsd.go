@@ -0,0 +1,244 @@
+package main
+
+// sysflux
+// Copyright (C) 2018 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/fnv"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+// ---------------------------------------------------------------------------------------
+//  types
+// ---------------------------------------------------------------------------------------
+
+// StatsDSink sends the fields of points as statsd metrics over udp. The metric
+// type of a field is configured by its mapping, fields without a mapping are
+// sent as gauges. Metrics are packed into datagrams of at most the payload size.
+// When a datagram can not be sent, a retry of a batch with the same content
+// only sends the remaining datagrams, so counters are not incremented twice.
+type StatsDSink struct {
+	Conf        ConfStatsD
+	Metrics     []*ConfMetric
+	PayloadSize int
+
+	// internal variables
+	conn   net.Conn
+	failed uint64
+	sent   int
+	sync.Mutex
+}
+
+// ---------------------------------------------------------------------------------------
+//  public functions
+// ---------------------------------------------------------------------------------------
+
+// NewStatsDSink creates a new statsd sink.
+func NewStatsDSink(conf *ConfOutput, timeout time.Duration) (*StatsDSink, error) {
+	conn, err := net.DialTimeout("udp", conf.Addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return &StatsDSink{
+		Conf:        conf.ConfStatsD,
+		Metrics:     conf.Metrics,
+		PayloadSize: conf.PayloadSize,
+		conn:        conn,
+	}, nil
+}
+
+// ---------------------------------------------------------------------------------------
+//  public members
+// ---------------------------------------------------------------------------------------
+
+// Write sends the numeric fields of all points. If the same points failed
+// before, e.g. when the batch is retried from the spool, only the datagrams
+// which have not been sent are sent again.
+func (s *StatsDSink) Write(bp client.BatchPoints) error {
+	s.Lock()
+	defer s.Unlock()
+
+	packets := s.packets(bp)
+	key := statsdBatchKey(bp.Points(), packets)
+
+	sent := 0
+	if key == s.failed {
+		sent = s.sent
+	}
+	s.failed, s.sent = 0, 0
+
+	for i := sent; i < len(packets); i++ {
+		_, err := s.conn.Write(packets[i])
+		if err != nil {
+			s.failed, s.sent = key, i
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Close closes the udp socket.
+func (s *StatsDSink) Close() error {
+	return s.conn.Close()
+}
+
+// ---------------------------------------------------------------------------------------
+//  private members
+// ---------------------------------------------------------------------------------------
+
+// packets formats the numeric fields of all points and packs them
+// into datagrams. The same points always result in the same datagrams.
+func (s *StatsDSink) packets(bp client.BatchPoints) [][]byte {
+	var packets [][]byte
+	var packet bytes.Buffer
+	for _, pt := range bp.Points() {
+		tags := s.tags(pt.Tags())
+
+		fields := pt.Fields()
+		names := make([]string, 0, len(fields))
+		for field := range fields {
+			names = append(names, field)
+		}
+		sort.Strings(names)
+
+		for _, field := range names {
+			value, err := toNumber(fields[field])
+			if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+				continue
+			}
+
+			for _, line := range s.lines(pt.Name(), field, value, tags) {
+				// a metric is never split, a packet holds at least one
+				if packet.Len() > 0 && packet.Len()+1+len(line) > s.PayloadSize {
+					packets = append(packets, append([]byte(nil), packet.Bytes()...))
+					packet.Reset()
+				}
+
+				if packet.Len() > 0 {
+					packet.WriteByte('\n')
+				}
+				packet.WriteString(line)
+			}
+		}
+	}
+
+	if packet.Len() > 0 {
+		packets = append(packets, packet.Bytes())
+	}
+
+	return packets
+}
+
+// lines formats the value of a field as statsd metric.
+func (s *StatsDSink) lines(measurement, field string, value float64, tags string) []string {
+	conf := ConfMetric{Type: MetricGauge}
+	for _, m := range s.Metrics {
+		if m.Field == field && (m.Measurement == "" || m.Measurement == measurement) {
+			conf = *m
+			break
+		}
+	}
+
+	name := conf.Name
+	if name == "" {
+		name = measurement + "." + field
+	}
+	name = statsdSanitize(s.Conf.Prefix + name)
+
+	formatted := strconv.FormatFloat(value, 'f', -1, 64)
+	switch conf.Type {
+	case MetricCounter:
+		return []string{name + ":" + formatted + "|c" + tags}
+
+	case MetricTimer:
+		return []string{name + ":" + formatted + "|ms" + tags}
+	}
+
+	// a signed gauge value is a relative change, so a negative
+	// value can only be set by resetting the gauge to zero first
+	if value < 0 {
+		return []string{name + ":0|g" + tags, name + ":" + formatted + "|g" + tags}
+	}
+
+	return []string{name + ":" + formatted + "|g" + tags}
+}
+
+// tags formats the tags in the dogstatsd notation.
+// Plain statsd does not support tags.
+func (s *StatsDSink) tags(tags map[string]string) string {
+	if !s.Conf.DogStatsD || len(tags) < 1 {
+		return ""
+	}
+
+	pairs := make([]string, 0, len(tags))
+	for name, value := range tags {
+		pairs = append(pairs, statsdSanitize(name)+":"+statsdSanitize(value))
+	}
+	sort.Strings(pairs)
+
+	return "|#" + strings.Join(pairs, ",")
+}
+
+// ---------------------------------------------------------------------------------------
+//  private functions
+// ---------------------------------------------------------------------------------------
+
+// statsdBatchKey identifies a batch by the timestamps
+// of its points and the resulting datagrams.
+func statsdBatchKey(points []*client.Point, packets [][]byte) uint64 {
+	h := fnv.New64a()
+	var buf [8]byte
+	for _, pt := range points {
+		binary.LittleEndian.PutUint64(buf[:], uint64(pt.Time().UnixNano()))
+		h.Write(buf[:])
+	}
+	for _, packet := range packets {
+		h.Write(packet)
+		h.Write([]byte{0})
+	}
+
+	return h.Sum64()
+}
+
+// statsdSanitize replaces the separators of the statsd
+// protocol and whitespace by an underscore.
+func statsdSanitize(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		switch c {
+		case ':', '|', '@', '#', ',', ' ', '\t', '\n', '\r':
+			b[i] = '_'
+		}
+	}
+
+	return string(b)
+}
@@ -0,0 +1,75 @@
+package main
+
+// sysflux
+// Copyright (C) 2018 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"io"
+	"os"
+	"sync"
+
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+// ---------------------------------------------------------------------------------------
+//  types
+// ---------------------------------------------------------------------------------------
+
+// StdoutSink prints the points in the line protocol or as
+// pretty json instead of writing them to an output.
+type StdoutSink struct {
+	Format string
+
+	// internal variables
+	out io.Writer
+	sync.Mutex
+}
+
+// ---------------------------------------------------------------------------------------
+//  public functions
+// ---------------------------------------------------------------------------------------
+
+// NewStdoutSink creates a new sink printing to stdout.
+func NewStdoutSink(format string) *StdoutSink {
+	return &StdoutSink{Format: format, out: os.Stdout}
+}
+
+// ---------------------------------------------------------------------------------------
+//  public members
+// ---------------------------------------------------------------------------------------
+
+// Write prints all points of the batch.
+func (s *StdoutSink) Write(bp client.BatchPoints) error {
+	buf, err := FormatPoints(bp.Points(), s.Format, true)
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	_, err = s.out.Write(buf)
+	return err
+}
+
+// Close does nothing, stdout stays open.
+func (s *StdoutSink) Close() error {
+	return nil
+}
@@ -0,0 +1,141 @@
+package main
+
+// sysflux
+// Copyright (C) 2018 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"encoding/binary"
+)
+
+// --------------------------------------------------------------------------------------
+//  constants
+// --------------------------------------------------------------------------------------
+
+const (
+	snappyMaxBlockSize = 65536
+	snappyTableBits    = 14
+	snappyMinInputSize = 17
+
+	snappyTagLiteral = 0x00
+	snappyTagCopy2   = 0x02
+)
+
+// ---------------------------------------------------------------------------------------
+//  public functions
+// ---------------------------------------------------------------------------------------
+
+// SnappyEncode compresses the data with the snappy block format
+// as expected by the prometheus remote write protocol.
+func SnappyEncode(src []byte) []byte {
+	var header [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(header[:], uint64(len(src)))
+
+	dst := make([]byte, n, n+len(src)+len(src)/6+32)
+	copy(dst, header[:n])
+
+	// every block is compressed on its own, which limits
+	// the offsets of copies to 16 bit
+	for len(src) > 0 {
+		block := src
+		if len(block) > snappyMaxBlockSize {
+			block = block[:snappyMaxBlockSize]
+		}
+		src = src[len(block):]
+
+		dst = snappyEncodeBlock(dst, block)
+	}
+
+	return dst
+}
+
+// ---------------------------------------------------------------------------------------
+//  private functions
+// ---------------------------------------------------------------------------------------
+
+// snappyEncodeBlock appends the compressed block to dst. Matches of at
+// least four bytes are found with a hash table of previous positions.
+func snappyEncodeBlock(dst, src []byte) []byte {
+	if len(src) < snappyMinInputSize {
+		return snappyEmitLiteral(dst, src)
+	}
+
+	// the table stores the position + 1, zero marks an empty slot
+	var table [1 << snappyTableBits]int32
+
+	s, nextEmit := 0, 0
+	for s+4 <= len(src) {
+		cur := binary.LittleEndian.Uint32(src[s:])
+		h := (cur * 0x1e35a7bd) >> (32 - snappyTableBits)
+		candidate := int(table[h]) - 1
+		table[h] = int32(s + 1)
+
+		if candidate < 0 || binary.LittleEndian.Uint32(src[candidate:]) != cur {
+			s++
+			continue
+		}
+
+		dst = snappyEmitLiteral(dst, src[nextEmit:s])
+
+		// extend the match as far as possible
+		length := 4
+		for s+length < len(src) && src[s+length] == src[candidate+length] {
+			length++
+		}
+
+		dst = snappyEmitCopy(dst, s-candidate, length)
+		s += length
+		nextEmit = s
+	}
+
+	return snappyEmitLiteral(dst, src[nextEmit:])
+}
+
+// snappyEmitLiteral appends a literal chunk to dst.
+func snappyEmitLiteral(dst, lit []byte) []byte {
+	if len(lit) < 1 {
+		return dst
+	}
+
+	n := len(lit) - 1
+	switch {
+	case n < 60:
+		dst = append(dst, byte(n)<<2|snappyTagLiteral)
+	case n < 1<<8:
+		dst = append(dst, 60<<2|snappyTagLiteral, byte(n))
+	default:
+		dst = append(dst, 61<<2|snappyTagLiteral, byte(n), byte(n>>8))
+	}
+
+	return append(dst, lit...)
+}
+
+// snappyEmitCopy appends copy chunks with a two byte offset to dst.
+func snappyEmitCopy(dst []byte, offset, length int) []byte {
+	for length > 0 {
+		n := length
+		if n > 64 {
+			n = 64
+		}
+		dst = append(dst, byte(n-1)<<2|snappyTagCopy2, byte(offset), byte(offset>>8))
+		length -= n
+	}
+
+	return dst
+}
@@ -0,0 +1,480 @@
+package main
+
+// sysflux
+// Copyright (C) 2018 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/influxdata/influxdb/models"
+	"github.com/sirupsen/logrus"
+)
+
+// --------------------------------------------------------------------------------------
+//  constants
+// --------------------------------------------------------------------------------------
+
+const (
+	spoolSegmentSize   = 16 << 20
+	spoolSegmentSuffix = ".seg"
+	spoolPositionFile  = "position"
+
+	// length and point count of a record
+	spoolHeaderSize = 8
+)
+
+// ---------------------------------------------------------------------------------------
+//  types
+// ---------------------------------------------------------------------------------------
+
+// Spool is a write-ahead log of batches on disk. Batches are appended to
+// numbered segment files and read back in order. The read position is
+// persisted, so the spool survives a restart. Fully read segments are
+// removed. The spool is not safe for concurrent use.
+type Spool struct {
+	Dir      string
+	MaxBytes int64
+	MaxAge   time.Duration
+
+	// internal variables
+	segments []*spoolSegment
+	seq      int64
+	writer   *os.File
+	reader   *os.File
+	readOff  int64
+	nextOff  int64
+	size     int64
+	points   int
+}
+
+type spoolSegment struct {
+	seq      int64
+	path     string
+	size     int64
+	modified time.Time
+}
+
+// spoolRecord is a spooled batch.
+type spoolRecord struct {
+	Database         string `json:"database"`
+	RetentionPolicy  string `json:"retention_policy"`
+	Precision        string `json:"precision"`
+	WriteConsistency string `json:"write_consistency"`
+	Points           string `json:"points"`
+}
+
+// ---------------------------------------------------------------------------------------
+//  public functions
+// ---------------------------------------------------------------------------------------
+
+// OpenSpool opens the spool in the given directory, which is created if
+// necessary. Batches spooled before a restart are read first.
+func OpenSpool(dir string, maxBytes int64, maxAge time.Duration) (*Spool, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	s := Spool{Dir: dir, MaxBytes: maxBytes, MaxAge: maxAge}
+	err = s.load()
+	if err != nil {
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+// ---------------------------------------------------------------------------------------
+//  public members
+// ---------------------------------------------------------------------------------------
+
+// Append writes the batch to the spool. The number of points dropped
+// to stay within the size and age limits is returned.
+func (s *Spool) Append(bp client.BatchPoints) (int, error) {
+	var points strings.Builder
+	for _, pt := range bp.Points() {
+		points.WriteString(pt.String())
+		points.WriteByte('\n')
+	}
+
+	payload, err := json.Marshal(spoolRecord{
+		Database:         bp.Database(),
+		RetentionPolicy:  bp.RetentionPolicy(),
+		Precision:        bp.Precision(),
+		WriteConsistency: bp.WriteConsistency(),
+		Points:           points.String(),
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	record := make([]byte, spoolHeaderSize, spoolHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:], uint32(len(bp.Points())))
+	record = append(record, payload...)
+
+	if s.writer == nil || s.last().size >= spoolSegmentSize {
+		err = s.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// a partially written record is overwritten by the next one
+	segment := s.last()
+	n, err := s.writer.WriteAt(record, segment.size)
+	if err != nil {
+		return 0, err
+	}
+	segment.size += int64(n)
+	segment.modified = time.Now()
+	s.size += int64(n)
+	s.points += len(bp.Points())
+
+	return s.enforceLimits(), nil
+}
+
+// Peek returns the oldest batch of the spool without removing it.
+// Nil is returned if the spool is empty.
+func (s *Spool) Peek() (client.BatchPoints, error) {
+	for len(s.segments) > 0 {
+		segment := s.segments[0]
+
+		if s.reader == nil {
+			reader, err := os.Open(segment.path)
+			if err != nil {
+				return nil, err
+			}
+			s.reader = reader
+		}
+
+		bp, size, err := s.read(s.reader, s.readOff)
+		if err == nil {
+			s.nextOff = s.readOff + size
+			return bp, nil
+		}
+
+		// the segment which is written to is never skipped
+		if segment == s.last() && s.writer != nil {
+			if err == io.EOF {
+				return nil, nil
+			}
+			return nil, err
+		}
+
+		// the rest of a corrupted segment is skipped, the
+		// replay continues with the next segment
+		if err != io.EOF {
+			logrus.Warnf("spool %s: skipping corrupted segment %s: %s",
+				s.Dir, segment.path, err.Error())
+		}
+		s.points -= s.count(segment, s.readOff)
+		s.removeFirst()
+	}
+
+	return nil, nil
+}
+
+// Ack removes the batch returned by the last call to Peek.
+func (s *Spool) Ack(points int) {
+	s.readOff = s.nextOff
+	s.points -= points
+	s.savePosition()
+
+	// the end of a segment is reached once the next
+	// segment exists, which is checked by the next peek
+	segment := s.segments[0]
+	if s.readOff >= segment.size && segment != s.last() {
+		s.removeFirst()
+	}
+}
+
+// Empty returns true if all spooled batches have been read.
+func (s *Spool) Empty() bool {
+	return len(s.segments) < 1 || (len(s.segments) == 1 && s.readOff >= s.segments[0].size)
+}
+
+// Points returns the number of spooled points.
+func (s *Spool) Points() int {
+	return s.points
+}
+
+// Close closes the segment files.
+func (s *Spool) Close() error {
+	if s.reader != nil {
+		s.reader.Close()
+	}
+	if s.writer != nil {
+		return s.writer.Close()
+	}
+
+	return nil
+}
+
+// ---------------------------------------------------------------------------------------
+//  private members
+// ---------------------------------------------------------------------------------------
+
+// load reads the segments and the read position from disk.
+func (s *Spool) load() error {
+	files, err := filepath.Glob(filepath.Join(s.Dir, "*"+spoolSegmentSuffix))
+	if err != nil {
+		return err
+	}
+
+	for _, path := range files {
+		seq, err := strconv.ParseInt(strings.TrimSuffix(filepath.Base(path), spoolSegmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+
+		s.segments = append(s.segments, &spoolSegment{seq, path, info.Size(), info.ModTime()})
+		s.size += info.Size()
+	}
+	sort.Slice(s.segments, func(i, j int) bool {
+		return s.segments[i].seq < s.segments[j].seq
+	})
+
+	// segments before the read position have been fully read
+	seq, offset := s.loadPosition()
+	s.seq = seq
+	if len(s.segments) > 0 && s.last().seq > s.seq {
+		s.seq = s.last().seq
+	}
+	for len(s.segments) > 0 && s.segments[0].seq < seq {
+		s.removeFirst()
+	}
+	if len(s.segments) > 0 && s.segments[0].seq == seq {
+		s.readOff = offset
+	}
+
+	for i, segment := range s.segments {
+		start := int64(0)
+		if i == 0 {
+			start = s.readOff
+		}
+		s.points += s.count(segment, start)
+	}
+
+	if s.points > 0 {
+		logrus.Infof("spool %s: %d points of a previous run will be replayed", s.Dir, s.points)
+	}
+
+	return nil
+}
+
+// loadPosition reads the persisted read position.
+func (s *Spool) loadPosition() (int64, int64) {
+	buf, err := ioutil.ReadFile(filepath.Join(s.Dir, spoolPositionFile))
+	if err != nil {
+		return 0, 0
+	}
+
+	var seq, offset int64
+	_, err = fmt.Sscanf(string(buf), "%d %d", &seq, &offset)
+	if err != nil {
+		logrus.Warnf("spool %s: invalid read position: %s", s.Dir, err.Error())
+		return 0, 0
+	}
+
+	return seq, offset
+}
+
+// savePosition persists the read position atomically.
+func (s *Spool) savePosition() {
+	if len(s.segments) < 1 {
+		return
+	}
+
+	path := filepath.Join(s.Dir, spoolPositionFile)
+	position := fmt.Sprintf("%d %d\n", s.segments[0].seq, s.readOff)
+	err := ioutil.WriteFile(path+".tmp", []byte(position), 0644)
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		logrus.Errorf("spool %s: failed to save read position: %s", s.Dir, err.Error())
+	}
+}
+
+// rotate starts a new segment. Segments of a previous run are never
+// appended to, because they might end with a partially written record.
+func (s *Spool) rotate() error {
+	// sequence numbers are never reused, the read position
+	// might still refer to the last removed segment
+	s.seq++
+	path := filepath.Join(s.Dir, fmt.Sprintf("%020d%s", s.seq, spoolSegmentSuffix))
+	writer, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	if s.writer != nil {
+		s.writer.Close()
+	}
+	s.writer = writer
+	s.segments = append(s.segments, &spoolSegment{s.seq, path, 0, time.Now()})
+
+	return nil
+}
+
+// read reads the record at the given offset. The batch
+// and the size of the record are returned.
+func (s *Spool) read(r io.ReaderAt, offset int64) (client.BatchPoints, int64, error) {
+	var header [spoolHeaderSize]byte
+	_, err := r.ReadAt(header[:], offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint32(header[0:]))
+	_, err = r.ReadAt(payload, offset+spoolHeaderSize)
+	if err == io.EOF {
+		return nil, 0, errors.New("truncated record")
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var record spoolRecord
+	err = json.Unmarshal(payload, &record)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	bp, err := client.NewBatchPoints(client.BatchPointsConfig{
+		Database:         record.Database,
+		RetentionPolicy:  record.RetentionPolicy,
+		Precision:        record.Precision,
+		WriteConsistency: record.WriteConsistency,
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// the points are stored with nanosecond timestamps
+	points, err := models.ParsePointsWithPrecision([]byte(record.Points), time.Now(), "n")
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, pt := range points {
+		bp.AddPoint(client.NewPointFrom(pt))
+	}
+
+	return bp, int64(spoolHeaderSize + len(payload)), nil
+}
+
+// count returns the number of points in the segment after the offset.
+// A truncated record at the end of the segment is not counted.
+func (s *Spool) count(segment *spoolSegment, offset int64) int {
+	file, err := os.Open(segment.path)
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+
+	points := 0
+	var header [spoolHeaderSize]byte
+	for offset+spoolHeaderSize <= segment.size {
+		_, err := file.ReadAt(header[:], offset)
+		if err != nil {
+			break
+		}
+
+		offset += spoolHeaderSize + int64(binary.BigEndian.Uint32(header[0:]))
+		if offset > segment.size {
+			break
+		}
+		points += int(binary.BigEndian.Uint32(header[4:]))
+	}
+
+	return points
+}
+
+// enforceLimits removes the oldest segments until the spool is within the size
+// and age limits. The segment which is written to is never removed.
+func (s *Spool) enforceLimits() int {
+	dropped := 0
+	for len(s.segments) > 1 {
+		oldest := s.segments[0]
+		tooLarge := s.MaxBytes > 0 && s.size > s.MaxBytes
+		tooOld := s.MaxAge > 0 && time.Since(oldest.modified) > s.MaxAge
+		if !tooLarge && !tooOld {
+			break
+		}
+
+		points := s.count(oldest, s.readOff)
+		s.points -= points
+		dropped += points
+		s.removeFirst()
+	}
+
+	return dropped
+}
+
+// removeFirst deletes the oldest segment and moves
+// the read position to the start of the next one.
+func (s *Spool) removeFirst() {
+	segment := s.segments[0]
+	if segment == s.last() && s.writer != nil {
+		s.writer.Close()
+		s.writer = nil
+	}
+	if s.reader != nil {
+		s.reader.Close()
+		s.reader = nil
+	}
+
+	err := os.Remove(segment.path)
+	if err != nil {
+		logrus.Errorf("spool %s: failed to remove segment: %s", s.Dir, err.Error())
+	}
+
+	s.size -= segment.size
+	s.segments = s.segments[1:]
+	s.readOff = 0
+	s.nextOff = 0
+	s.savePosition()
+}
+
+func (s *Spool) last() *spoolSegment {
+	if len(s.segments) < 1 {
+		return nil
+	}
+
+	return s.segments[len(s.segments)-1]
+}
@@ -0,0 +1,262 @@
+package main
+
+// sysflux
+// Copyright (C) 2018 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+// ---------------------------------------------------------------------------------------
+//  tests
+// ---------------------------------------------------------------------------------------
+
+func TestSpoolReplayAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+
+	spool := openTestSpool(t, dir)
+	appendTestBatch(t, spool, "a", 2)
+	appendTestBatch(t, spool, "b", 3)
+	spool.Close()
+
+	spool = openTestSpool(t, dir)
+	if spool.Points() != 5 {
+		t.Fatalf("expected 5 spooled points, got %d", spool.Points())
+	}
+	expectBatches(t, spool, "a", "b")
+	if !spool.Empty() || spool.Points() != 0 {
+		t.Errorf("expected empty spool, got %d points", spool.Points())
+	}
+}
+
+func TestSpoolCrashBeforeAck(t *testing.T) {
+	dir := t.TempDir()
+
+	spool := openTestSpool(t, dir)
+	appendTestBatch(t, spool, "a", 1)
+	appendTestBatch(t, spool, "b", 1)
+
+	// the batch was sent, but the process died before the ack
+	peekTestBatch(t, spool, "a")
+	spool.Close()
+
+	// batches are delivered at least once
+	spool = openTestSpool(t, dir)
+	peekTestBatch(t, spool, "a")
+	spool.Ack(1)
+	spool.Close()
+
+	// acknowledged batches are not replayed
+	spool = openTestSpool(t, dir)
+	if spool.Points() != 1 {
+		t.Errorf("expected 1 spooled point, got %d", spool.Points())
+	}
+	expectBatches(t, spool, "b")
+}
+
+func TestSpoolCorruptedLastRecord(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(path string, size int64) error
+	}{
+		{"truncated", func(path string, size int64) error {
+			return os.Truncate(path, size-5)
+		}},
+		{"garbage", func(path string, size int64) error {
+			// overwrite the end of the json payload of the last record
+			file, err := os.OpenFile(path, os.O_WRONLY, 0644)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			_, err = file.WriteAt([]byte("\x00\x00"), size-2)
+			return err
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+
+			// the first segment ends with the corrupted record
+			spool := openTestSpool(t, dir)
+			appendTestBatch(t, spool, "a", 1)
+			appendTestBatch(t, spool, "b", 2)
+			segment := spool.last()
+			spool.Close()
+
+			spool = openTestSpool(t, dir)
+			appendTestBatch(t, spool, "c", 4)
+			spool.Close()
+
+			err := test.corrupt(segment.path, segment.size)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the replay continues with the next segment
+			spool = openTestSpool(t, dir)
+			expectBatches(t, spool, "a", "c")
+			if !spool.Empty() || spool.Points() != 0 {
+				t.Errorf("expected empty spool, got %d points", spool.Points())
+			}
+		})
+	}
+}
+
+func TestSpoolRemoveReadSegments(t *testing.T) {
+	dir := t.TempDir()
+
+	// every restart starts a new segment
+	spool := openTestSpool(t, dir)
+	appendTestBatch(t, spool, "a", 1)
+	appendTestBatch(t, spool, "b", 1)
+	spool.Close()
+
+	spool = openTestSpool(t, dir)
+	appendTestBatch(t, spool, "c", 1)
+	if segments := spoolSegments(t, dir); len(segments) != 2 {
+		t.Fatalf("expected 2 segments, got %v", segments)
+	}
+
+	// the first segment is removed once it has been fully read
+	spool.Ack(len(peekTestBatch(t, spool, "a").Points()))
+	if segments := spoolSegments(t, dir); len(segments) != 2 {
+		t.Fatalf("expected 2 segments, got %v", segments)
+	}
+	spool.Ack(len(peekTestBatch(t, spool, "b").Points()))
+	segments := spoolSegments(t, dir)
+	if len(segments) != 1 || segments[0] != filepath.Base(spool.last().path) {
+		t.Fatalf("expected the second segment only, got %v", segments)
+	}
+
+	// the segment which is written to is kept
+	expectBatches(t, spool, "c")
+	if segments := spoolSegments(t, dir); len(segments) != 1 {
+		t.Fatalf("expected 1 segment, got %v", segments)
+	}
+	spool.Close()
+
+	// a fully read segment of a previous run is removed by the replay
+	spool = openTestSpool(t, dir)
+	expectBatches(t, spool)
+	if segments := spoolSegments(t, dir); len(segments) != 0 {
+		t.Fatalf("expected no segments, got %v", segments)
+	}
+}
+
+// ---------------------------------------------------------------------------------------
+//  helpers
+// ---------------------------------------------------------------------------------------
+
+// openTestSpool opens the spool in the given directory without limits.
+func openTestSpool(t *testing.T, dir string) *Spool {
+	t.Helper()
+
+	spool, err := OpenSpool(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { spool.Close() })
+
+	return spool
+}
+
+// appendTestBatch spools a batch with the given number
+// of points of the measurement.
+func appendTestBatch(t *testing.T, spool *Spool, measurement string, points int) {
+	t.Helper()
+
+	bp, _ := client.NewBatchPoints(client.BatchPointsConfig{Database: "logs"})
+	for i := 0; i < points; i++ {
+		pt, err := client.NewPoint(measurement, nil, map[string]interface{}{"i": i}, time.Unix(int64(i), 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		bp.AddPoint(pt)
+	}
+
+	_, err := spool.Append(bp)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// peekTestBatch checks the measurement of the next spooled batch.
+func peekTestBatch(t *testing.T, spool *Spool, measurement string) client.BatchPoints {
+	t.Helper()
+
+	bp, err := spool.Peek()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bp == nil {
+		t.Fatalf("expected batch %s, spool is empty", measurement)
+	}
+	if name := bp.Points()[0].Name(); name != measurement || bp.Database() != "logs" {
+		t.Fatalf("expected batch %s of database logs, got %s of %s", measurement, name, bp.Database())
+	}
+
+	return bp
+}
+
+// expectBatches reads and acknowledges the given batches
+// and checks that no other batches are spooled.
+func expectBatches(t *testing.T, spool *Spool, measurements ...string) {
+	t.Helper()
+
+	for _, measurement := range measurements {
+		bp := peekTestBatch(t, spool, measurement)
+		spool.Ack(len(bp.Points()))
+	}
+
+	bp, err := spool.Peek()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bp != nil {
+		t.Fatalf("unexpected batch %s", bp.Points()[0].Name())
+	}
+}
+
+// spoolSegments returns the names of the segment files.
+func spoolSegments(t *testing.T, dir string) []string {
+	t.Helper()
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	segments := make([]string, 0)
+	for _, file := range files {
+		if filepath.Ext(file.Name()) == spoolSegmentSuffix {
+			segments = append(segments, file.Name())
+		}
+	}
+
+	return segments
+}
@@ -0,0 +1,124 @@
+package main
+
+// sysflux
+// Copyright (C) 2018 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ---------------------------------------------------------------------------------------
+//  variables
+// ---------------------------------------------------------------------------------------
+
+var (
+	outputStats = expvar.NewMap("outputs")
+	nodeStats   = expvar.NewMap("nodes")
+	healthStats = expvar.NewMap("health")
+
+	// points dropped because the queue of a batch was full
+	queueDropped = expvar.NewInt("queue_dropped_points")
+
+	// points without a resolvable database
+	unroutedPoints = expvar.NewInt("unrouted_points")
+)
+
+// ---------------------------------------------------------------------------------------
+//  types
+// ---------------------------------------------------------------------------------------
+
+// OutputStats are the counters of an output, which are
+// published in the "outputs" map of the expvar endpoint.
+type OutputStats struct {
+	Written  *expvar.Int
+	Failed   *expvar.Int
+	Dropped  *expvar.Int
+	Buffered *expvar.Int
+	Spooled  *expvar.Int
+}
+
+// ---------------------------------------------------------------------------------------
+//  public functions
+// ---------------------------------------------------------------------------------------
+
+// NewOutputStats creates and publishes the counters of an output
+// under the given display name.
+func NewOutputStats(name string) *OutputStats {
+	stats := OutputStats{
+		Written:  new(expvar.Int),
+		Failed:   new(expvar.Int),
+		Dropped:  new(expvar.Int),
+		Buffered: new(expvar.Int),
+		Spooled:  new(expvar.Int),
+	}
+
+	m := new(expvar.Map).Init()
+	m.Set("written_points", stats.Written)
+	m.Set("failed_writes", stats.Failed)
+	m.Set("dropped_points", stats.Dropped)
+	m.Set("buffered_points", stats.Buffered)
+	m.Set("spooled_points", stats.Spooled)
+	outputStats.Set(name, m)
+
+	return &stats
+}
+
+// ServeStats serves the statistics of sysflux in the expvar
+// json format on /debug/vars of the given address and the
+// health of the outputs on /health.
+func ServeStats(listen string) {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/health", serveHealth)
+
+	logrus.Infof("serving statistics on %s/debug/vars", listen)
+	go func() {
+		err := http.ListenAndServe(listen, mux)
+		if err != nil {
+			logrus.Errorln("statistics endpoint failed:", err.Error())
+		}
+	}()
+}
+
+// ---------------------------------------------------------------------------------------
+//  private functions
+// ---------------------------------------------------------------------------------------
+
+// serveHealth responds with the health of all checked outputs.
+// The status is 503 if any output is unhealthy.
+func serveHealth(w http.ResponseWriter, r *http.Request) {
+	status := http.StatusOK
+	health := make(map[string]bool)
+	healthStats.Do(func(kv expvar.KeyValue) {
+		healthy := kv.Value.(*expvar.Int).Value() == 1
+		if !healthy {
+			status = http.StatusServiceUnavailable
+		}
+		health[kv.Key] = healthy
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(health)
+}
@@ -0,0 +1,131 @@
+package main
+
+// sysflux
+// Copyright (C) 2018 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"errors"
+	"strings"
+)
+
+// ---------------------------------------------------------------------------------------
+//  types
+// ---------------------------------------------------------------------------------------
+
+// Template is a string containing {name} placeholders which
+// are replaced by the captures of a log message.
+type Template struct {
+	Source string
+
+	// literal text and placeholder names alternate,
+	// starting and ending with literal text
+	literals []string
+	names    []string
+}
+
+// ---------------------------------------------------------------------------------------
+//  public functions
+// ---------------------------------------------------------------------------------------
+
+// CompileTemplate parses the given template. All placeholders must
+// be contained in known, otherwise an error is returned. If known is nil
+// all placeholders are accepted.
+func CompileTemplate(src string, known map[string]bool) (*Template, error) {
+	t := Template{Source: src}
+
+	rest := src
+	for {
+		open := strings.IndexByte(rest, '{')
+		if open < 0 {
+			t.literals = append(t.literals, rest)
+			break
+		}
+
+		end := strings.IndexByte(rest[open:], '}')
+		if end < 0 {
+			return nil, errors.New("unterminated placeholder in template \"" + src + "\"")
+		}
+
+		name := rest[open+1 : open+end]
+		if known != nil && !known[name] {
+			return nil, errors.New("unknown placeholder {" + name + "} in template \"" + src + "\"")
+		}
+
+		t.literals = append(t.literals, rest[:open])
+		t.names = append(t.names, name)
+		rest = rest[open+end+1:]
+	}
+
+	return &t, nil
+}
+
+// SanitizeName converts the given string into a name which is valid
+// as an influxdb measurement. Characters which need quoting are replaced
+// by an underscore and leading underscores are removed, because
+// names starting with an underscore are reserved by influxdb.
+func SanitizeName(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		isAlphaNum := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+		if !isAlphaNum && c != '-' && c != '.' {
+			b[i] = '_'
+		}
+	}
+
+	return strings.TrimLeft(string(b), "_")
+}
+
+// ---------------------------------------------------------------------------------------
+//  public members
+// ---------------------------------------------------------------------------------------
+
+// IsStatic returns true if the template does not contain any placeholders.
+func (t *Template) IsStatic() bool {
+	return len(t.names) < 1
+}
+
+// Execute replaces all placeholders with the given variables.
+// Missing variables are replaced by an empty string.
+func (t *Template) Execute(vars map[string]string) string {
+	s, _ := t.Resolve(vars)
+	return s
+}
+
+// Resolve replaces all placeholders with the given variables. False
+// is returned if a variable is missing or empty.
+func (t *Template) Resolve(vars map[string]string) (string, bool) {
+	if t.IsStatic() {
+		return t.literals[0], true
+	}
+
+	resolved := true
+	var b strings.Builder
+	for i, name := range t.names {
+		b.WriteString(t.literals[i])
+		value := vars[name]
+		if value == "" {
+			resolved = false
+		}
+		b.WriteString(value)
+	}
+	b.WriteString(t.literals[len(t.literals)-1])
+
+	return b.String(), resolved
+}
@@ -0,0 +1,206 @@
+package main
+
+// sysflux
+// Copyright (C) 2018 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ---------------------------------------------------------------------------------------
+//  types
+// ---------------------------------------------------------------------------------------
+
+// tlsFiles holds the client certificate and the ca bundle of a tls configuration.
+// The files are reloaded on the next handshake when they have been modified.
+type tlsFiles struct {
+	conf ConfTLS
+	host string
+
+	// internal variables
+	cert     *tls.Certificate
+	pool     *x509.CertPool
+	modified map[string]time.Time
+	sync.Mutex
+}
+
+// ---------------------------------------------------------------------------------------
+//  public functions
+// ---------------------------------------------------------------------------------------
+
+// NewTLSConfig creates the tls client configuration for connections to
+// the given host. Nil is returned if no tls settings are configured.
+func NewTLSConfig(conf *ConfTLS, host string) (*tls.Config, error) {
+	if *conf == (ConfTLS{}) {
+		return nil, nil
+	}
+
+	if conf.ServerName != "" {
+		host = conf.ServerName
+	}
+	files := &tlsFiles{conf: *conf, host: host, modified: make(map[string]time.Time)}
+	err := files.reload()
+	if err != nil {
+		return nil, err
+	}
+
+	config := tls.Config{
+		ServerName:         conf.ServerName,
+		InsecureSkipVerify: conf.InsecureSkipVerify,
+	}
+
+	if conf.Cert != "" {
+		config.GetClientCertificate = files.clientCertificate
+	}
+
+	// the standard verification can't use a reloaded ca bundle,
+	// so the certificates are verified by the callback instead
+	if conf.CA != "" && !conf.InsecureSkipVerify {
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = files.verifyConnection
+	}
+
+	return &config, nil
+}
+
+// NewHTTPTransport creates a http transport using
+// the tls configuration for requests to the given url.
+func NewHTTPTransport(conf *ConfTLS, addr string) (*http.Transport, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := NewTLSConfig(conf, u.Hostname())
+	if err != nil {
+		return nil, err
+	}
+
+	return &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: config,
+	}, nil
+}
+
+// ---------------------------------------------------------------------------------------
+//  private members
+// ---------------------------------------------------------------------------------------
+
+// clientCertificate returns the current client certificate.
+func (f *tlsFiles) clientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	f.reloadOrKeep()
+	return f.cert, nil
+}
+
+// verifyConnection verifies the certificate chain of the server against
+// the current ca bundle. The server name is not available for ip addresses,
+// so the certificate is verified for the configured host instead.
+func (f *tlsFiles) verifyConnection(state tls.ConnectionState) error {
+	if len(state.PeerCertificates) < 1 {
+		return errors.New("server did not present a certificate")
+	}
+
+	f.Lock()
+	f.reloadOrKeep()
+	opts := x509.VerifyOptions{
+		Roots:         f.pool,
+		DNSName:       f.host,
+		Intermediates: x509.NewCertPool(),
+	}
+	f.Unlock()
+
+	for _, cert := range state.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+
+	_, err := state.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+// reloadOrKeep reloads the modified files. The previous certificates are
+// kept if the files can not be loaded, e.g. while they are being replaced.
+func (f *tlsFiles) reloadOrKeep() {
+	err := f.reload()
+	if err != nil {
+		logrus.Warnln("failed to reload tls certificates, keeping the previous ones:", err.Error())
+	}
+}
+
+// reload loads the files which have been modified since the last load.
+func (f *tlsFiles) reload() error {
+	if f.conf.Cert != "" && (f.changed(f.conf.Cert) || f.changed(f.conf.Key)) {
+		cert, err := tls.LoadX509KeyPair(f.conf.Cert, f.conf.Key)
+		if err != nil {
+			return err
+		}
+		f.cert = &cert
+		f.loaded(f.conf.Cert, f.conf.Key)
+	}
+
+	if f.conf.CA != "" && f.changed(f.conf.CA) {
+		buf, err := ioutil.ReadFile(f.conf.CA)
+		if err != nil {
+			return err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(buf) {
+			return errors.New("no certificates found in " + f.conf.CA)
+		}
+		f.pool = pool
+		f.loaded(f.conf.CA)
+	}
+
+	return nil
+}
+
+// changed returns true if the file has been modified since it was loaded.
+func (f *tlsFiles) changed(path string) bool {
+	info, err := os.Stat(path)
+	if err != nil {
+		// the error is reported when loading the file
+		return true
+	}
+
+	return !info.ModTime().Equal(f.modified[path])
+}
+
+// loaded remembers the modification time of the loaded files.
+func (f *tlsFiles) loaded(paths ...string) {
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err == nil {
+			f.modified[path] = info.ModTime()
+		}
+	}
+}